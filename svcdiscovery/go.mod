@@ -5,5 +5,14 @@ go 1.14
 require (
 	github.com/caddyserver/caddy v1.0.5
 	github.com/coredns/coredns v1.7.0
-	github.com/miekg/dns v1.1.31
+	github.com/dnstap/golang-dnstap v0.2.0
+	github.com/miekg/dns v1.1.42
+	github.com/nats-io/nats-server/v2 v2.1.8
+	github.com/nats-io/nats.go v1.10.0
+	github.com/opentracing/opentracing-go v1.1.0
+	github.com/prometheus/client_golang v1.6.0
+	k8s.io/api v0.18.3
+	k8s.io/apimachinery v0.18.3
+	k8s.io/client-go v0.18.3
+	sigs.k8s.io/yaml v1.2.0
 )
@@ -0,0 +1,149 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// accessControl restricts the resolution of the internal names by the source
+// address of the clients. The rules are evaluated in order and the first
+// matching one applies. Names not matched by any rule are allowed.
+type accessControl struct {
+	rules []aclRule
+}
+
+// aclRule allows or denies the resolution of the names, or of every name when
+// empty, to the clients in the sources.
+type aclRule struct {
+	allow   bool
+	sources []*net.IPNet
+	// names are zones, matching themselves and the names under them, or
+	// patterns containing a *, e.g. *-prod.apps.internal.
+	names []string
+}
+
+// parseACLRule parses an acl rule: allow|deny CIDR... [to NAME...].
+func parseACLRule(action string, args []string) (aclRule, error) {
+	var rule aclRule
+	switch action {
+	case "allow":
+		rule.allow = true
+	case "deny":
+	default:
+		return rule, fmt.Errorf("invalid acl action: %s", action)
+	}
+
+	i := 0
+	for ; i < len(args) && args[i] != "to"; i++ {
+		_, subnet, err := net.ParseCIDR(args[i])
+		if err != nil {
+			return rule, fmt.Errorf("failed to parse acl subnet: %w", err)
+		}
+		rule.sources = append(rule.sources, subnet)
+	}
+	if len(rule.sources) == 0 {
+		return rule, fmt.Errorf("acl rule requires at least one subnet")
+	}
+	if i < len(args) {
+		if i == len(args)-1 {
+			return rule, fmt.Errorf("acl rule requires at least one name after to")
+		}
+		for _, name := range args[i+1:] {
+			name = plugin.Name(name).Normalize()
+			if strings.Contains(name, "*") {
+				if _, err := path.Match(name, ""); err != nil {
+					return rule, fmt.Errorf("invalid acl pattern %s: %w", name, err)
+				}
+			}
+			rule.names = append(rule.names, name)
+		}
+	}
+	return rule, nil
+}
+
+// allowed returns whether the client is allowed to resolve qname.
+func (ac *accessControl) allowed(ip net.IP, qname string) bool {
+	qname = strings.ToLower(dns.Fqdn(qname))
+	for _, rule := range ac.rules {
+		if rule.matches(ip, qname) {
+			return rule.allow
+		}
+	}
+	return true
+}
+
+// allowedAll returns whether the client is allowed to resolve all the names,
+// along with the first denied one.
+func (ac *accessControl) allowedAll(ip net.IP, names ...string) (string, bool) {
+	for _, name := range names {
+		if !ac.allowed(ip, name) {
+			return name, false
+		}
+	}
+	return "", true
+}
+
+func (r aclRule) matches(ip net.IP, qname string) bool {
+	if !containsIP(r.sources, ip) {
+		return false
+	}
+	if len(r.names) == 0 {
+		return true
+	}
+	for _, name := range r.names {
+		if strings.Contains(name, "*") {
+			if ok, _ := path.Match(name, qname); ok {
+				return true
+			}
+		} else if dns.IsSubDomain(name, qname) {
+			return true
+		}
+	}
+	return false
+}
+
+// refuse answers REFUSED to a client denied the resolution of the name.
+func (sd *ServiceDiscovery) refuse(rw dns.ResponseWriter, req *dns.Msg, name string) (int, error) {
+	state := request.Request{W: rw, Req: req}
+	sd.log.Warningf("%s: denied resolution of %s to %s", state.Name(), name, state.IP())
+	if err := refuse(rw, req); err != nil {
+		sd.log.Error(err)
+		return dns.RcodeServerFailure, err
+	}
+	return dns.RcodeSuccess, nil
+}
+
+// refuse answers REFUSED with the Prohibited extended DNS error.
+func refuse(rw dns.ResponseWriter, req *dns.Msg) error {
+	res := &dns.Msg{}
+	res.SetRcode(req, dns.RcodeRefused)
+	if opt := req.IsEdns0(); opt != nil {
+		res.SetEdns0(opt.UDPSize(), opt.Do())
+		res.IsEdns0().Option = append(res.IsEdns0().Option, &dns.EDNS0_EDE{
+			InfoCode: dns.ExtendedErrorCodeProhibited,
+		})
+	}
+	return rw.WriteMsg(res)
+}
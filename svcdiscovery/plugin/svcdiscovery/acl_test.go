@@ -0,0 +1,188 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestAccessControl(t *testing.T) {
+	rule := func(action string, args ...string) aclRule {
+		r, err := parseACLRule(action, args)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	ac := &accessControl{rules: []aclRule{
+		rule("allow", "10.240.0.0/24", "to", "v4.apps.internal"),
+		rule("deny", "10.240.0.0/16", "to", "apps.internal", "*-prod.example.com"),
+	}}
+
+	tests := []struct {
+		ip      string
+		qname   string
+		allowed bool
+	}{
+		{"10.240.0.1", "v4.apps.internal.", true},
+		{"10.240.0.1", "v6.apps.internal.", false},
+		{"10.240.1.1", "V4.Apps.Internal.", false},
+		{"10.240.1.1", "db-prod.example.com.", false},
+		{"10.240.1.1", "db-dev.example.com.", true},
+		{"10.241.0.1", "v6.apps.internal.", true},
+	}
+	for _, tt := range tests {
+		if allowed := ac.allowed(net.ParseIP(tt.ip), tt.qname); allowed != tt.allowed {
+			t.Errorf("%s from %s: expected allowed %t, got %t", tt.qname, tt.ip, tt.allowed, allowed)
+		}
+	}
+
+	for _, args := range [][]string{{}, {"to", "apps.internal"}, {"10.0.0.0/8", "to"}, {"apps.internal"}} {
+		if _, err := parseACLRule("deny", args); err == nil {
+			t.Errorf("expected an error for %v", args)
+		}
+	}
+}
+
+func TestServeDNSRefused(t *testing.T) {
+	sd := newTestServiceDiscovery()
+	_, subnet, _ := net.ParseCIDR("10.240.0.0/16")
+	sd.acl = &accessControl{rules: []aclRule{{sources: []*net.IPNet{subnet}}}}
+
+	req := new(dns.Msg)
+	req.SetQuestion("v4.apps.internal.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if _, err := sd.ServeDNS(context.Background(), rec, req); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Msg.Rcode != dns.RcodeRefused || len(rec.Msg.Answer) != 0 {
+		t.Fatalf("expected REFUSED, got %v", rec.Msg)
+	}
+	opt := rec.Msg.IsEdns0()
+	if opt == nil || len(opt.Option) != 1 {
+		t.Fatalf("expected an extended DNS error, got %v", rec.Msg)
+	}
+	if ede, ok := opt.Option[0].(*dns.EDNS0_EDE); !ok || ede.InfoCode != dns.ExtendedErrorCodeProhibited {
+		t.Errorf("expected the Prohibited extended DNS error, got %v", opt.Option[0])
+	}
+}
+
+func TestServeDNSRefusedResolvedNames(t *testing.T) {
+	deny := func(names ...string) *accessControl {
+		r, err := parseACLRule("deny", append([]string{"10.240.0.0/16", "to"}, names...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &accessControl{rules: []aclRule{r}}
+	}
+
+	tests := []struct {
+		name    string
+		modify  func(sd *ServiceDiscovery)
+		qname   string
+		refused bool
+	}{
+		{
+			name: "alias to a denied route",
+			modify: func(sd *ServiceDiscovery) {
+				sd.aliases = newAliases()
+				sd.aliases.static["old.apps.internal."] = "v4.apps.internal."
+				sd.acl = deny("v4.apps.internal")
+			},
+			qname:   "old.apps.internal.",
+			refused: true,
+		},
+		{
+			name: "alias to an allowed route",
+			modify: func(sd *ServiceDiscovery) {
+				sd.aliases = newAliases()
+				sd.aliases.static["old.apps.internal."] = "v4.apps.internal."
+				sd.acl = deny("v6.apps.internal")
+			},
+			qname: "old.apps.internal.",
+		},
+		{
+			name: "alias tag to a denied route",
+			modify: func(sd *ServiceDiscovery) {
+				sd.aliases = newAliases()
+				sd.aliases.tag = "alias_of"
+				sd.discoverer = fakeDiscoverer{
+					"old.apps.internal.": {{IPAddress: "10.11.12.13", Tags: map[string]interface{}{"alias_of": "v6.apps.internal"}}},
+					"v6.apps.internal.":  fakeRoutes["v6.apps.internal."],
+				}
+				sd.acl = deny("v6.apps.internal")
+			},
+			qname:   "old.apps.internal.",
+			refused: true,
+		},
+		{
+			name: "wildcard to a denied route",
+			modify: func(sd *ServiceDiscovery) {
+				sd.wildcards = wildcards{"team.apps.internal.": "db.apps.internal."}
+				sd.acl = deny("db.apps.internal")
+			},
+			qname:   "peer.team.apps.internal.",
+			refused: true,
+		},
+		{
+			name: "instance index of a denied route",
+			modify: func(sd *ServiceDiscovery) {
+				sd.acl = deny("db.apps.internal")
+			},
+			qname:   "0.db.apps.internal.",
+			refused: true,
+		},
+		{
+			name: "instance index of a denied route pattern",
+			modify: func(sd *ServiceDiscovery) {
+				sd.acl = deny("db.*.internal")
+			},
+			qname:   "0.db.apps.internal.",
+			refused: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sd := newTestServiceDiscovery()
+			tt.modify(sd)
+
+			req := new(dns.Msg)
+			req.SetQuestion(tt.qname, dns.TypeA)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			if _, err := sd.ServeDNS(context.Background(), rec, req); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Msg == nil {
+				t.Fatal("no answer")
+			}
+			if refused := rec.Msg.Rcode == dns.RcodeRefused; refused != tt.refused {
+				t.Errorf("expected refused %t, got %v", tt.refused, rec.Msg)
+			}
+			if tt.refused && len(rec.Msg.Answer) != 0 {
+				t.Errorf("expected no answer, got %v", rec.Msg.Answer)
+			}
+		})
+	}
+}
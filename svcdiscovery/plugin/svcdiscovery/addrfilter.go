@@ -0,0 +1,65 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"net"
+)
+
+// addressFilter validates the addresses returned by the SDC before they are
+// used in an answer, so that a misregistration cannot point clients at
+// addresses that are never valid for an app container.
+type addressFilter struct {
+	// allow, when not empty, restricts the answers to the addresses contained
+	// in one of the subnets.
+	allow []*net.IPNet
+	// deny rejects the addresses contained in one of the subnets. It takes
+	// precedence over allow.
+	deny []*net.IPNet
+}
+
+// check returns the reason for rejecting the address, or an empty string if
+// the address is acceptable.
+func (f *addressFilter) check(ipStr string) string {
+	ip := net.ParseIP(ipStr)
+	switch {
+	case ip == nil:
+		return "invalid"
+	case ip.IsUnspecified():
+		return "unspecified"
+	case ip.IsLoopback():
+		return "loopback"
+	case ip.IsLinkLocalUnicast():
+		return "link_local"
+	case ip.IsMulticast():
+		return "multicast"
+	case containsIP(f.deny, ip):
+		return "denied"
+	case len(f.allow) > 0 && !containsIP(f.allow, ip):
+		return "not_allowed"
+	}
+	return ""
+}
+
+func containsIP(subnets []*net.IPNet, ip net.IP) bool {
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
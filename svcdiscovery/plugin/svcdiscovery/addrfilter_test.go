@@ -0,0 +1,92 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAddressFilterCheck(t *testing.T) {
+	subnets := func(cidrs ...string) []*net.IPNet {
+		var subnets []*net.IPNet
+		for _, cidr := range cidrs {
+			_, subnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			subnets = append(subnets, subnet)
+		}
+		return subnets
+	}
+
+	tests := []struct {
+		name     string
+		filter   addressFilter
+		ip       string
+		expected string
+	}{
+		{name: "valid IPv4", ip: "10.11.12.13", expected: ""},
+		{name: "valid IPv6", ip: "fd00::1", expected: ""},
+		{name: "invalid", ip: "not-an-ip", expected: "invalid"},
+		{name: "unspecified IPv4", ip: "0.0.0.0", expected: "unspecified"},
+		{name: "unspecified IPv6", ip: "::", expected: "unspecified"},
+		{name: "loopback IPv4", ip: "127.0.0.1", expected: "loopback"},
+		{name: "loopback IPv6", ip: "::1", expected: "loopback"},
+		{name: "link-local IPv4", ip: "169.254.1.1", expected: "link_local"},
+		{name: "link-local IPv6", ip: "fe80::1", expected: "link_local"},
+		{name: "multicast IPv4", ip: "224.0.0.1", expected: "multicast"},
+		{name: "multicast IPv6", ip: "ff02::1", expected: "multicast"},
+		{
+			name:     "allowed",
+			filter:   addressFilter{allow: subnets("10.0.0.0/8")},
+			ip:       "10.11.12.13",
+			expected: "",
+		},
+		{
+			name:     "not allowed",
+			filter:   addressFilter{allow: subnets("10.0.0.0/8")},
+			ip:       "192.168.1.1",
+			expected: "not_allowed",
+		},
+		{
+			name:     "denied",
+			filter:   addressFilter{deny: subnets("10.11.0.0/16")},
+			ip:       "10.11.12.13",
+			expected: "denied",
+		},
+		{
+			name:     "deny takes precedence over allow",
+			filter:   addressFilter{allow: subnets("10.0.0.0/8"), deny: subnets("10.11.0.0/16")},
+			ip:       "10.11.12.13",
+			expected: "denied",
+		},
+		{
+			name:     "allowed outside of the denied subnet",
+			filter:   addressFilter{allow: subnets("10.0.0.0/8"), deny: subnets("10.11.0.0/16")},
+			ip:       "10.12.0.1",
+			expected: "",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if reason := tc.filter.check(tc.ip); reason != tc.expected {
+				t.Errorf("expected %q, got %q", tc.expected, reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/caddyfile"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	adminSnapshotPath    = "/snapshot"
+	adminSDCPath         = "/sdc"
+	adminConfigPath      = "/config"
+	adminShutdownTimeout = 5 * time.Second
+	// The requests are bounded so that slow clients can't hold connections.
+	adminReadHeaderTimeout = 5 * time.Second
+	adminReadTimeout       = 10 * time.Second
+	adminWriteTimeout      = 30 * time.Second
+)
+
+// adminServer is an HTTP listener for troubleshooting the plugin. It exposes
+// the routes table of the snapshot, the reachability of the Service Discovery
+// Controller and the configuration in effect, and allows flushing routes from
+// the snapshot.
+type adminServer struct {
+	addr string
+	// token is the bearer token required from the clients. No authentication
+	// is required when it's empty.
+	token string
+	// snapshot holds the routes table of the snapshot. The snapshot endpoints
+	// are not implemented when it's nil.
+	snapshot *snapshotDiscoverer
+	sdc      []*SDCClient
+	// config is the plugin configuration, one directive per line.
+	config []string
+	log    clog.P
+
+	server *http.Server
+}
+
+func newAdminServer() *adminServer {
+	return &adminServer{log: clog.NewWithPlugin(pluginName)}
+}
+
+// Start starts listening.
+func (as *adminServer) Start() error {
+	ln, err := net.Listen("tcp", as.addr)
+	if err != nil {
+		return fmt.Errorf("failed to start admin listener: %w", err)
+	}
+	as.server = &http.Server{
+		Handler:           as.handler(),
+		ReadHeaderTimeout: adminReadHeaderTimeout,
+		ReadTimeout:       adminReadTimeout,
+		WriteTimeout:      adminWriteTimeout,
+	}
+	go func() {
+		if err := as.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			as.log.Errorf("Admin listener failed: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Stop stops listening. It's a no-op if it's not listening.
+func (as *adminServer) Stop() error {
+	if as.server == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+	defer cancel()
+	err := as.server.Shutdown(ctx)
+	as.server = nil
+	return err
+}
+
+func (as *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(adminSnapshotPath, as.serveSnapshot)
+	mux.HandleFunc(adminSnapshotPath+"/", as.serveSnapshot)
+	mux.HandleFunc(adminSDCPath, as.serveSDC)
+	mux.HandleFunc(adminConfigPath, as.serveConfig)
+	return as.authenticate(mux)
+}
+
+// authenticate requires the bearer token from the clients, if any.
+func (as *adminServer) authenticate(next http.Handler) http.Handler {
+	if as.token == "" {
+		return next
+	}
+	expected := []byte("Bearer " + as.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serveSnapshot serves the routes table of the snapshot at /snapshot, and a
+// single route at /snapshot/NAME. Both are flushed from the snapshot with the
+// DELETE method. The live answers are not affected, they are only served from
+// the snapshot while the backends fail.
+func (as *adminServer) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	if as.snapshot == nil {
+		http.Error(w, "no snapshot: snapshot_path is not configured", http.StatusNotImplemented)
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, adminSnapshotPath), "/")
+	if name != "" {
+		name = dns.Fqdn(strings.ToLower(name))
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		routes := as.snapshot.table()
+		if name == "" {
+			writeJSON(w, routes)
+			return
+		}
+		hosts, ok := routes[name]
+		if !ok {
+			http.Error(w, fmt.Sprintf("route not in the snapshot: %s", name), http.StatusNotFound)
+			return
+		}
+		writeJSON(w, hosts)
+	case http.MethodDelete:
+		if name == "" {
+			as.snapshot.flushAll()
+			as.log.Info("Flushed the snapshot from the admin listener")
+		} else if as.snapshot.flush(name) {
+			as.log.Infof("%s: flushed from the snapshot from the admin listener", name)
+		} else {
+			http.Error(w, fmt.Sprintf("route not in the snapshot: %s", name), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+// serveSDC serves the reachability of the Service Discovery Controller.
+func (as *adminServer) serveSDC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	statuses := make([]sdcStatus, len(as.sdc))
+	for i, sdcc := range as.sdc {
+		statuses[i] = sdcc.status()
+	}
+	writeJSON(w, statuses)
+}
+
+// serveConfig serves the plugin configuration in effect.
+func (as *adminServer) serveConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, line := range as.config {
+		fmt.Fprintln(w, line)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// blockConfig returns the lines of the plugin block, indented by nesting
+// level, with the value of the admin_token directive redacted. The dispenser
+// is a copy, positioned on the plugin name.
+func blockConfig(d caddyfile.Dispenser) []string {
+	lines := []string{pluginName}
+	if !d.NextArg() || d.Val() != "{" {
+		return lines
+	}
+	lines[0] += " {"
+	depth := 1
+	for depth > 0 && d.Next() {
+		if d.Val() == "}" {
+			depth--
+			lines = append(lines, strings.Repeat("\t", depth)+"}")
+			continue
+		}
+		words := []string{d.Val()}
+		for d.NextArg() {
+			words = append(words, d.Val())
+		}
+		if words[0] == "admin_token" {
+			words = append(words[:1], "REDACTED")
+		}
+		lines = append(lines, strings.Repeat("\t", depth)+strings.Join(words, " "))
+		if words[len(words)-1] == "{" {
+			depth++
+		}
+	}
+	return lines
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+)
+
+func adminRequest(t *testing.T, handler http.Handler, method, path, token string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestAdminServerSnapshot(t *testing.T) {
+	snapshot := newSnapshotDiscoverer(fakeRoutes, "", defaultSnapshotInterval)
+	snapshot.routes["v4.apps.internal."] = fakeRoutes["v4.apps.internal."]
+	snapshot.routes["v6.apps.internal."] = fakeRoutes["v6.apps.internal."]
+	as := newAdminServer()
+	as.token = "secret"
+	as.snapshot = snapshot
+	handler := as.handler()
+
+	if rec := adminRequest(t, handler, http.MethodGet, "/snapshot", ""); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected an unauthenticated request to be unauthorized, got %d", rec.Code)
+	}
+	if rec := adminRequest(t, handler, http.MethodGet, "/snapshot", "wrong"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected a wrong token to be unauthorized, got %d", rec.Code)
+	}
+
+	rec := adminRequest(t, handler, http.MethodGet, "/snapshot", "secret")
+	var routes map[string][]Host
+	if err := json.Unmarshal(rec.Body.Bytes(), &routes); err != nil {
+		t.Fatal(err)
+	}
+	if len(routes) != 2 {
+		t.Errorf("expected 2 snapshot routes, got %v", routes)
+	}
+
+	if rec := adminRequest(t, handler, http.MethodDelete, "/snapshot/V4.apps.internal", "secret"); rec.Code != http.StatusNoContent {
+		t.Errorf("expected the route to be flushed, got %d", rec.Code)
+	}
+	if rec := adminRequest(t, handler, http.MethodGet, "/snapshot/v4.apps.internal.", "secret"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected the flushed route not to be found, got %d", rec.Code)
+	}
+	if rec := adminRequest(t, handler, http.MethodGet, "/snapshot/v6.apps.internal.", "secret"); rec.Code != http.StatusOK {
+		t.Errorf("expected the other route to be found, got %d", rec.Code)
+	}
+
+	if rec := adminRequest(t, handler, http.MethodDelete, "/snapshot", "secret"); rec.Code != http.StatusNoContent {
+		t.Errorf("expected the snapshot to be flushed, got %d", rec.Code)
+	}
+	if routes := snapshot.table(); len(routes) != 0 {
+		t.Errorf("expected an empty snapshot, got %v", routes)
+	}
+
+	// The snapshot endpoints are not implemented without a snapshot.
+	as.snapshot = nil
+	if rec := adminRequest(t, as.handler(), http.MethodGet, "/snapshot", "secret"); rec.Code != http.StatusNotImplemented {
+		t.Errorf("expected the snapshot endpoint not to be implemented, got %d", rec.Code)
+	}
+}
+
+func TestAdminServerSDC(t *testing.T) {
+	sdcc := &SDCClient{sdcURLBase: "https://sdc.service.cf.internal:8054/v1/registration/"}
+	as := newAdminServer()
+	as.sdc = []*SDCClient{sdcc}
+	handler := as.handler()
+
+	sdcc.record(nil)
+	sdcc.record(errors.New("connection refused"))
+
+	rec := adminRequest(t, handler, http.MethodGet, "/sdc", "")
+	var statuses []sdcStatus
+	if err := json.Unmarshal(rec.Body.Bytes(), &statuses); err != nil {
+		t.Fatal(err)
+	}
+	if len(statuses) != 1 {
+		t.Fatalf("expected 1 SDC status, got %+v", statuses)
+	}
+	status := statuses[0]
+	if status.URL != sdcc.sdcURLBase || status.Reachable || status.LastContact == nil || status.LastError != "connection refused" {
+		t.Errorf("unexpected SDC status: %+v", status)
+	}
+
+	sdcc.record(nil)
+	if status := sdcc.status(); !status.Reachable {
+		t.Errorf("expected the SDC to be reachable after a successful request: %+v", status)
+	}
+}
+
+func TestBlockConfig(t *testing.T) {
+	c := caddy.NewTestController("dns", `svcdiscovery {
+		sdc_host sdc.service.cf.internal
+		acl {
+			deny 10.0.0.0/8
+		}
+		admin_listen 127.0.0.1:8090
+		admin_token secret
+	}`)
+	c.Next()
+
+	expected := []string{
+		"svcdiscovery {",
+		"\tsdc_host sdc.service.cf.internal",
+		"\tacl {",
+		"\t\tdeny 10.0.0.0/8",
+		"\t}",
+		"\tadmin_listen 127.0.0.1:8090",
+		"\tadmin_token REDACTED",
+		"}",
+	}
+	config := blockConfig(c.Dispenser)
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("expected config:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(config, "\n"))
+	}
+	if c.Val() != "svcdiscovery" {
+		t.Errorf("expected the dispenser not to be advanced, got %s", c.Val())
+	}
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const defaultAliasMaxChain = 8
+
+// aliases maps internal route names to the names they are an alias of, which
+// are answered with a CNAME record.
+type aliases struct {
+	// static are the configured aliases, keyed by their lower-case name.
+	static map[string]string
+	// tag is the host tag naming the target of the route when all of its hosts
+	// carry it. It's ignored when empty.
+	tag string
+	// maxChain is the maximum number of CNAME records in an answer.
+	maxChain int
+}
+
+func newAliases() *aliases {
+	return &aliases{
+		static:   make(map[string]string),
+		maxChain: defaultAliasMaxChain,
+	}
+}
+
+// configured returns the target of the configured alias for the name.
+func (a *aliases) configured(name string) (string, bool) {
+	target, ok := a.static[strings.ToLower(name)]
+	return target, ok
+}
+
+// tagged returns the target named by the alias tag of the hosts, if all of
+// them carry the same one.
+func (a *aliases) tagged(hosts []Host) (string, bool) {
+	if a.tag == "" || len(hosts) == 0 {
+		return "", false
+	}
+	var target string
+	for _, host := range hosts {
+		v, ok := host.Tag(a.tag)
+		if !ok || v == "" || (target != "" && dns.Fqdn(strings.ToLower(v)) != target) {
+			return "", false
+		}
+		target = dns.Fqdn(strings.ToLower(v))
+	}
+	return target, true
+}
+
+// resolution is the result of resolving a question name.
+type resolution struct {
+	// name is the name the hosts were discovered for, the question name or the
+	// target of the last alias.
+	name string
+	// chain are the CNAME records leading to name.
+	chain []dns.RR
+	hosts []Host
+	// routes are the route registrations looked up along the chain, including
+	// the routes of the instance-index and wildcard names.
+	routes []string
+}
+
+// names returns every name the resolution went through: the question name,
+// the alias targets and the routes looked up.
+func (r resolution) names() []string {
+	names := make([]string, 0, len(r.chain)+1+len(r.routes))
+	for _, rr := range r.chain {
+		names = append(names, rr.Header().Name)
+	}
+	names = append(names, r.name)
+	return append(names, r.routes...)
+}
+
+// resolve discovers the hosts of qname, following its aliases. Alias loops and
+// chains longer than the maximum are errors.
+func (sd *ServiceDiscovery) resolve(ctx context.Context, qname string) (resolution, error) {
+	res := resolution{name: qname}
+	for {
+		var hosts []Host
+		target, ok := "", false
+		if sd.aliases != nil {
+			target, ok = sd.aliases.configured(res.name)
+		}
+		if !ok {
+			start := time.Now()
+			route, discovered, err := sd.discover(ctx, res.name)
+			lookupInfoFrom(ctx).addLatency(time.Since(start))
+			if err != nil {
+				return resolution{}, err
+			}
+			hosts = discovered
+			res.routes = append(res.routes, route)
+			if sd.aliases != nil {
+				target, ok = sd.aliases.tagged(hosts)
+			}
+		}
+		if !ok {
+			res.hosts = hosts
+			return res, nil
+		}
+
+		if len(res.chain) >= sd.aliases.maxChain {
+			return resolution{}, fmt.Errorf("%s: alias chain longer than %d", qname, sd.aliases.maxChain)
+		}
+		if strings.EqualFold(target, qname) {
+			return resolution{}, fmt.Errorf("%s: alias loop through %s", qname, res.name)
+		}
+		for _, rr := range res.chain {
+			if strings.EqualFold(target, rr.Header().Name) {
+				return resolution{}, fmt.Errorf("%s: alias loop through %s", qname, res.name)
+			}
+		}
+		res.chain = append(res.chain, &dns.CNAME{
+			Hdr: dns.RR_Header{
+				Name:   res.name,
+				Rrtype: dns.TypeCNAME,
+				Class:  dns.ClassINET,
+				Ttl:    sd.ttl.answer(res.name, nil),
+			},
+			Target: target,
+		})
+		res.name = target
+	}
+}
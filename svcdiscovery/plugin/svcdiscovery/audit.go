@@ -0,0 +1,276 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const (
+	auditLogStdout = "stdout"
+
+	defaultAuditSampleRate = 1.0
+	defaultAuditMaxSize    = 100 * 1024 * 1024
+	defaultAuditMaxBackups = 3
+
+	// auditQueueSize is the number of entries waiting to be written beyond
+	// which the new entries are dropped.
+	auditQueueSize = 4096
+)
+
+// auditLog writes an audit entry, as a JSON line, for the internal route
+// lookups. The entries are queued and written by a goroutine, off the query
+// path. When written to a file, the file is rotated once it reaches the
+// maximum size.
+type auditLog struct {
+	// dropped counts the entries dropped since the last flush because the
+	// queue was full.
+	dropped uint64
+
+	// path is the path to the audit file, or stdout.
+	path       string
+	sampleRate float64
+	maxSize    int64
+	maxBackups int
+	log        clog.P
+
+	entries chan []byte
+	started bool
+
+	// The output is only used by the writer goroutine once started.
+	out  *bufio.Writer
+	file *os.File
+	size int64
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// auditEntry is an entry of the audit log.
+type auditEntry struct {
+	Time    time.Time `json:"time"`
+	Client  string    `json:"client"`
+	Qname   string    `json:"qname"`
+	Qtype   string    `json:"qtype"`
+	Rcode   string    `json:"rcode"`
+	Answers []string  `json:"answers"`
+	// BackendLatency is the time spent in the backends, in milliseconds.
+	BackendLatency float64 `json:"backend_latency_ms"`
+}
+
+func newAuditLog(path string) *auditLog {
+	return &auditLog{
+		path:       path,
+		sampleRate: defaultAuditSampleRate,
+		maxSize:    defaultAuditMaxSize,
+		maxBackups: defaultAuditMaxBackups,
+		log:        clog.NewWithPlugin(pluginName),
+		entries:    make(chan []byte, auditQueueSize),
+		stopCh:     make(chan struct{}),
+		doneCh:     make(chan struct{}),
+	}
+}
+
+// Start opens the audit file, appending to it, and starts writing the queued
+// entries.
+func (al *auditLog) Start() error {
+	if al.path == auditLogStdout {
+		al.out = bufio.NewWriter(os.Stdout)
+	} else if err := al.open(); err != nil {
+		return err
+	}
+	al.started = true
+	go al.run()
+	return nil
+}
+
+// Stop writes the queued entries and closes the audit file.
+func (al *auditLog) Stop() error {
+	if !al.started {
+		return nil
+	}
+	close(al.stopCh)
+	<-al.doneCh
+	if al.file == nil {
+		return nil
+	}
+	err := al.file.Close()
+	al.file = nil
+	al.out = nil
+	return err
+}
+
+// run writes the queued entries, flushing them whenever the queue is empty.
+func (al *auditLog) run() {
+	defer close(al.doneCh)
+	for {
+		select {
+		case line := <-al.entries:
+			al.writeLine(line)
+			if len(al.entries) == 0 {
+				al.flush()
+			}
+		case <-al.stopCh:
+			for {
+				select {
+				case line := <-al.entries:
+					al.writeLine(line)
+				default:
+					al.flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (al *auditLog) open() error {
+	file, err := os.OpenFile(al.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	al.file = file
+	al.out = bufio.NewWriter(file)
+	al.size = stat.Size()
+	return nil
+}
+
+// rotate renames the audit file to path.1, shifting the previous backups and
+// dropping the oldest one, and opens a new audit file.
+func (al *auditLog) rotate() error {
+	al.flush()
+	if err := al.file.Close(); err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+	al.file = nil
+	al.out = nil
+	if al.maxBackups == 0 {
+		if err := os.Remove(al.path); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+		return al.open()
+	}
+	for i := al.maxBackups - 1; i > 0; i-- {
+		from := fmt.Sprintf("%s.%d", al.path, i)
+		if _, err := os.Stat(from); err == nil {
+			if err := os.Rename(from, fmt.Sprintf("%s.%d", al.path, i+1)); err != nil {
+				return fmt.Errorf("failed to rotate audit log: %w", err)
+			}
+		}
+	}
+	if err := os.Rename(al.path, al.path+".1"); err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+	return al.open()
+}
+
+func (al *auditLog) sampled() bool {
+	return al.sampleRate >= 1 || rand.Float64() < al.sampleRate
+}
+
+// write queues the entry as a JSON line, dropping it when the queue is full.
+func (al *auditLog) write(entry auditEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		al.log.Errorf("Failed to write audit log: %v", err)
+		return
+	}
+	line = append(line, '\n')
+
+	select {
+	case al.entries <- line:
+	default:
+		atomic.AddUint64(&al.dropped, 1)
+	}
+}
+
+// writeLine writes the line, rotating the audit file first when it would
+// exceed the maximum size.
+func (al *auditLog) writeLine(line []byte) {
+	if al.file != nil && al.maxSize > 0 && al.size+int64(len(line)) > al.maxSize && al.size > 0 {
+		if err := al.rotate(); err != nil {
+			al.log.Error(err)
+		}
+	}
+	if al.out == nil {
+		return
+	}
+	n, err := al.out.Write(line)
+	al.size += int64(n)
+	if err != nil {
+		al.log.Errorf("Failed to write audit log: %v", err)
+	}
+}
+
+// flush flushes the written lines and reports the dropped entries.
+func (al *auditLog) flush() {
+	if dropped := atomic.SwapUint64(&al.dropped, 0); dropped > 0 {
+		al.log.Warningf("Dropped %d audit entries, the audit log is too slow", dropped)
+	}
+	if al.out == nil {
+		return
+	}
+	if err := al.out.Flush(); err != nil {
+		al.log.Errorf("Failed to write audit log: %v", err)
+	}
+}
+
+// auditLookup writes the audit entry of the route question answered with the
+// rcode, and with the recorded response if any.
+func (sd *ServiceDiscovery) auditLookup(state request.Request, rcode int, rec *dnstest.Recorder, info *lookupInfo) {
+	entry := auditEntry{
+		Time:    time.Now().UTC(),
+		Client:  state.IP(),
+		Qname:   state.Name(),
+		Qtype:   state.Type(),
+		Answers: []string{},
+	}
+	// The rcode is returned when the answer is left to the server to write.
+	result := rcode
+	if rec.Msg != nil {
+		result = rec.Rcode
+		for _, rr := range rec.Msg.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				entry.Answers = append(entry.Answers, rr.A.String())
+			case *dns.AAAA:
+				entry.Answers = append(entry.Answers, rr.AAAA.String())
+			}
+		}
+	}
+	entry.Rcode = dns.RcodeToString[result]
+	info.mu.Lock()
+	entry.BackendLatency = float64(info.latency) / float64(time.Millisecond)
+	info.mu.Unlock()
+	sd.audit.write(entry)
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func readAuditEntries(t *testing.T, path string) []auditEntry {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var entries []auditEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry auditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestServeDNSAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	sd := newTestServiceDiscovery()
+	sd.audit = newAuditLog(path)
+	if err := sd.audit.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The external names passed to the next plugin are not audited.
+	for _, qname := range []string{"v4.apps.internal.", "unknown.apps.internal.", "example.com."} {
+		req := new(dns.Msg)
+		req.SetQuestion(qname, dns.TypeA)
+		sd.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), req)
+	}
+	if err := sd.audit.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries := readAuditEntries(t, path)
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 audit entries, got %+v", entries)
+	}
+	entry := entries[0]
+	if entry.Client != "10.240.0.1" || entry.Qname != "v4.apps.internal." || entry.Qtype != "A" || entry.Rcode != "NOERROR" {
+		t.Errorf("unexpected audit entry: %+v", entry)
+	}
+	if !reflect.DeepEqual(entry.Answers, []string{"10.11.12.13", "10.11.12.14"}) {
+		t.Errorf("unexpected answers: %v", entry.Answers)
+	}
+	if entries[1].Rcode != "NXDOMAIN" || len(entries[1].Answers) != 0 {
+		t.Errorf("unexpected audit entry for an unknown route: %+v", entries[1])
+	}
+}
+
+func TestAuditLogRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	al := newAuditLog(path)
+	al.maxSize = 1
+	al.maxBackups = 2
+	if err := al.Start(); err != nil {
+		t.Fatal(err)
+	}
+	for _, qname := range []string{"a.", "b.", "c.", "d."} {
+		al.write(auditEntry{Qname: qname})
+	}
+	if err := al.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	for suffix, qname := range map[string]string{"": "d.", ".1": "c.", ".2": "b."} {
+		entries := readAuditEntries(t, path+suffix)
+		if len(entries) != 1 || entries[0].Qname != qname {
+			t.Errorf("expected %s in audit%s, got %+v", qname, suffix, entries)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("expected at most 2 backups, got %v", err)
+	}
+}
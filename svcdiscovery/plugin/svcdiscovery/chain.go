@@ -0,0 +1,176 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+)
+
+// chainPolicyType controls how the answers of chained backends are combined.
+type chainPolicyType int
+
+const (
+	// chainPolicyFirst answers from the first backend with a non-empty answer.
+	chainPolicyFirst chainPolicyType = iota
+	// chainPolicyMerge answers with the union of the hosts of all the backends.
+	chainPolicyMerge
+	// chainPolicyFallbackOnError answers from the first backend that doesn't
+	// fail, even if its answer is empty.
+	chainPolicyFallbackOnError
+)
+
+func parseChainPolicy(s string) (chainPolicyType, error) {
+	switch s {
+	case "first":
+		return chainPolicyFirst, nil
+	case "merge":
+		return chainPolicyMerge, nil
+	case "fallback_on_error":
+		return chainPolicyFallbackOnError, nil
+	default:
+		return 0, fmt.Errorf("invalid chain policy: %s", s)
+	}
+}
+
+// chainDiscoverer combines an ordered list of backends according to a policy.
+type chainDiscoverer struct {
+	names       []string
+	discoverers []Discoverer
+	policy      chainPolicyType
+	log         clog.P
+}
+
+// Discover satisfies Discoverer.Discover.
+func (cd *chainDiscoverer) Discover(ctx context.Context, domainName string) ([]Host, error) {
+	if cd.policy == chainPolicyMerge {
+		return cd.merge(ctx, domainName)
+	}
+
+	var firstErr error
+	for i, discoverer := range cd.discoverers {
+		hosts, err := discoverer.Discover(ctx, domainName)
+		if err != nil {
+			cd.log.Warningf("Backend %s failed: %v", cd.names[i], err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if len(hosts) > 0 || cd.policy == chainPolicyFallbackOnError {
+			return hosts, nil
+		}
+	}
+	// The route may be known to a failing backend, so an empty answer is
+	// only authoritative when no backend failed.
+	return nil, firstErr
+}
+
+// merge queries all the backends concurrently and returns the union of their
+// hosts, deduplicated by IP and port. It only fails when all the backends fail.
+func (cd *chainDiscoverer) merge(ctx context.Context, domainName string) ([]Host, error) {
+	results := make([][]Host, len(cd.discoverers))
+	errs := make([]error, len(cd.discoverers))
+	var wg sync.WaitGroup
+	for i, discoverer := range cd.discoverers {
+		wg.Add(1)
+		go func(i int, discoverer Discoverer) {
+			defer wg.Done()
+			results[i], errs[i] = discoverer.Discover(ctx, domainName)
+		}(i, discoverer)
+	}
+	wg.Wait()
+
+	var hosts []Host
+	seen := make(map[string]struct{})
+	failed := 0
+	for i, result := range results {
+		if errs[i] != nil {
+			cd.log.Warningf("Backend %s failed: %v", cd.names[i], errs[i])
+			failed++
+			continue
+		}
+		for _, host := range result {
+			key := host.key()
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			hosts = append(hosts, host)
+		}
+	}
+	if failed == len(cd.discoverers) {
+		return nil, errs[0]
+	}
+	return hosts, nil
+}
+
+// List combines the routes of the backends according to the policy. The first
+// policy takes each route from the first backend that knows it, while the
+// fallback_on_error policy lists the first backend that doesn't fail.
+func (cd *chainDiscoverer) List(ctx context.Context) (map[string][]Host, error) {
+	routes := make(map[string][]Host)
+	var firstErr error
+	failed := 0
+	for i, discoverer := range cd.discoverers {
+		backendRoutes, err := listRoutes(ctx, discoverer)
+		if err != nil {
+			cd.log.Warningf("Backend %s failed: %v", cd.names[i], err)
+			if firstErr == nil {
+				firstErr = err
+			}
+			failed++
+			continue
+		}
+		if cd.policy == chainPolicyFallbackOnError {
+			return backendRoutes, nil
+		}
+		for name, hosts := range backendRoutes {
+			if cd.policy == chainPolicyFirst {
+				if _, ok := routes[name]; !ok && len(hosts) > 0 {
+					routes[name] = hosts
+				}
+				continue
+			}
+			routes[name] = mergeHosts(routes[name], hosts)
+		}
+	}
+	if failed == len(cd.discoverers) {
+		return nil, firstErr
+	}
+	return routes, nil
+}
+
+// mergeHosts appends the hosts that are not already in the list, by IP and
+// port.
+func mergeHosts(list []Host, hosts []Host) []Host {
+	seen := make(map[string]struct{}, len(list))
+	for _, host := range list {
+		seen[host.key()] = struct{}{}
+	}
+	for _, host := range hosts {
+		if _, ok := seen[host.key()]; ok {
+			continue
+		}
+		seen[host.key()] = struct{}{}
+		list = append(list, host)
+	}
+	return list
+}
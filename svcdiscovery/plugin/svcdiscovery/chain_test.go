@@ -0,0 +1,124 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+)
+
+func TestChainDiscoverer(t *testing.T) {
+	primary := fakeDiscoverer{
+		"myapp.apps.internal.": {{IPAddress: "10.11.12.13"}},
+	}
+	secondary := fakeDiscoverer{
+		"myapp.apps.internal.": {{IPAddress: "10.11.12.13"}, {IPAddress: "10.11.12.14"}},
+		"other.apps.internal.": {{IPAddress: "10.11.12.15"}},
+		"error.apps.internal.": {{IPAddress: "10.11.12.16"}},
+	}
+
+	tests := []struct {
+		policy chainPolicyType
+		name   string
+		hosts  []Host
+	}{
+		{chainPolicyFirst, "myapp.apps.internal.", []Host{{IPAddress: "10.11.12.13"}}},
+		{chainPolicyFirst, "other.apps.internal.", []Host{{IPAddress: "10.11.12.15"}}},
+		{chainPolicyFirst, "error.apps.internal.", []Host{{IPAddress: "10.11.12.16"}}},
+		{chainPolicyMerge, "myapp.apps.internal.", []Host{{IPAddress: "10.11.12.13"}, {IPAddress: "10.11.12.14"}}},
+		{chainPolicyMerge, "error.apps.internal.", []Host{{IPAddress: "10.11.12.16"}}},
+		{chainPolicyFallbackOnError, "other.apps.internal.", nil},
+		{chainPolicyFallbackOnError, "error.apps.internal.", []Host{{IPAddress: "10.11.12.16"}}},
+	}
+
+	for _, tt := range tests {
+		cd := &chainDiscoverer{
+			names:       []string{"primary", "secondary"},
+			discoverers: []Discoverer{primary, secondary},
+			policy:      tt.policy,
+			log:         clog.NewWithPlugin(pluginName),
+		}
+		hosts, err := cd.Discover(context.Background(), tt.name)
+		if err != nil {
+			t.Errorf("policy %d, %s: unexpected error: %v", tt.policy, tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(hosts, tt.hosts) {
+			t.Errorf("policy %d, %s: expected %+v, got %+v", tt.policy, tt.name, tt.hosts, hosts)
+		}
+	}
+}
+
+func TestChainDiscovererFirstErrors(t *testing.T) {
+	failing := fakeDiscoverer{}
+	empty := fakeDiscoverer{"error.apps.internal.": {}}
+
+	tests := []struct {
+		name        string
+		discoverers []Discoverer
+		err         bool
+	}{
+		{"a backend fails and another has no hosts", []Discoverer{failing, empty}, true},
+		{"a backend has no hosts and another fails", []Discoverer{empty, failing}, true},
+		{"all the backends fail", []Discoverer{failing, failing}, true},
+		{"all the backends have no hosts", []Discoverer{empty, empty}, false},
+	}
+
+	for _, tt := range tests {
+		cd := &chainDiscoverer{
+			names:       []string{"primary", "secondary"},
+			discoverers: tt.discoverers,
+			policy:      chainPolicyFirst,
+			log:         clog.NewWithPlugin(pluginName),
+		}
+		hosts, err := cd.Discover(context.Background(), "error.apps.internal.")
+		if (err != nil) != tt.err {
+			t.Errorf("%s: expected error %t, got %v", tt.name, tt.err, err)
+		}
+		if len(hosts) != 0 {
+			t.Errorf("%s: expected no hosts, got %+v", tt.name, hosts)
+		}
+	}
+}
+
+func TestChainDiscovererSnapshot(t *testing.T) {
+	// The sdc backend fails during an outage while the file backend doesn't
+	// know the route, which must not remove it from the snapshot.
+	cd := &chainDiscoverer{
+		names:       []string{"sdc", "file"},
+		discoverers: []Discoverer{fakeDiscoverer{}, fakeDiscoverer{"error.apps.internal.": {}}},
+		policy:      chainPolicyFirst,
+		log:         clog.NewWithPlugin(pluginName),
+	}
+	stale := []Host{{IPAddress: "10.11.12.13"}}
+	sd := newSnapshotDiscoverer(cd, "", defaultSnapshotInterval)
+	sd.routes["error.apps.internal."] = stale
+	sd.stale["error.apps.internal."] = struct{}{}
+
+	for i := 0; i < 2; i++ {
+		hosts, err := sd.Discover(context.Background(), "error.apps.internal.")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(hosts, stale) {
+			t.Errorf("expected the snapshot hosts, got %+v", hosts)
+		}
+	}
+}
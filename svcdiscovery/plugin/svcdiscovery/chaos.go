@@ -0,0 +1,114 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// Version is the version of the plugin, set at build time.
+var Version = "dev"
+
+// The CHAOS TXT names answered for introspection.
+const (
+	chaosVersionName = "version.svcdiscovery."
+	chaosStatusName  = "status.svcdiscovery."
+	chaosSDCName     = "sdc.svcdiscovery."
+)
+
+// chaosResponder answers the CHAOS TXT introspection questions from the
+// allowed clients.
+type chaosResponder struct {
+	allow []*net.IPNet
+	sdc   []*SDCClient
+	// snapshot holds the routes table of the snapshot. Its size is left out of
+	// the status when it's nil.
+	snapshot *snapshotDiscoverer
+}
+
+// answers returns whether the question is answered by the responder.
+func (cr *chaosResponder) answers(qclass, qtype uint16, qname string) bool {
+	if qclass != dns.ClassCHAOS || qtype != dns.TypeTXT {
+		return false
+	}
+	switch dns.CanonicalName(qname) {
+	case chaosVersionName, chaosStatusName, chaosSDCName:
+		return true
+	default:
+		return false
+	}
+}
+
+// txt returns the TXT strings answering the name.
+func (cr *chaosResponder) txt(name string) []string {
+	switch name {
+	case chaosVersionName:
+		return []string{Version}
+	case chaosStatusName:
+		var lastContact time.Time
+		for _, sdcc := range cr.sdc {
+			if status := sdcc.status(); status.LastContact != nil && status.LastContact.After(lastContact) {
+				lastContact = *status.LastContact
+			}
+		}
+		txt := []string{"last_sdc_contact=never"}
+		if !lastContact.IsZero() {
+			txt[0] = "last_sdc_contact=" + lastContact.UTC().Format(time.RFC3339)
+		}
+		if cr.snapshot != nil {
+			txt = append(txt, "snapshot_routes="+strconv.Itoa(len(cr.snapshot.table())))
+		}
+		return txt
+	case chaosSDCName:
+		txt := make([]string, len(cr.sdc))
+		for i, sdcc := range cr.sdc {
+			txt[i] = sdcc.sdcURLBase
+		}
+		return txt
+	default:
+		return nil
+	}
+}
+
+// serveChaos answers the CHAOS TXT introspection question, refusing the
+// clients that are not allowed.
+func (sd *ServiceDiscovery) serveChaos(rw dns.ResponseWriter, req *dns.Msg) (int, error) {
+	state := request.Request{W: rw, Req: req}
+	if !containsIP(sd.chaos.allow, net.ParseIP(state.IP())) {
+		return dns.RcodeRefused, nil
+	}
+
+	name := dns.CanonicalName(state.Name())
+	res := new(dns.Msg)
+	res.SetReply(req)
+	res.Authoritative = true
+	for _, txt := range sd.chaos.txt(name) {
+		res.Answer = append(res.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: state.QName(), Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0},
+			Txt: []string{txt},
+		})
+	}
+	if err := rw.WriteMsg(res); err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	return dns.RcodeSuccess, nil
+}
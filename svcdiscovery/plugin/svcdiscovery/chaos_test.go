@@ -0,0 +1,123 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func chaosTXT(t *testing.T, sd *ServiceDiscovery, qname string) []string {
+	req := new(dns.Msg)
+	req.SetQuestion(qname, dns.TypeTXT)
+	req.Question[0].Qclass = dns.ClassCHAOS
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if code, err := sd.ServeDNS(context.Background(), rec, req); code != dns.RcodeSuccess || err != nil {
+		t.Fatalf("%s: unexpected rcode %d: %v", qname, code, err)
+	}
+	var txt []string
+	for _, rr := range rec.Msg.Answer {
+		txt = append(txt, rr.(*dns.TXT).Txt...)
+	}
+	return txt
+}
+
+func TestServeDNSChaos(t *testing.T) {
+	sdcc := &SDCClient{sdcURLBase: "https://sdc.service.cf.internal:8054/v1/registration/"}
+	snapshot := newSnapshotDiscoverer(fakeRoutes, "", defaultSnapshotInterval)
+	snapshot.routes["v4.apps.internal."] = fakeRoutes["v4.apps.internal."]
+	_, subnet, _ := net.ParseCIDR("10.240.0.0/16")
+	sd := newTestServiceDiscovery()
+	sd.chaos = &chaosResponder{
+		allow:    []*net.IPNet{subnet},
+		sdc:      []*SDCClient{sdcc},
+		snapshot: snapshot,
+	}
+
+	tests := []struct {
+		qname    string
+		expected []string
+	}{
+		{qname: "version.svcdiscovery.", expected: []string{Version}},
+		{qname: "sdc.svcdiscovery.", expected: []string{sdcc.sdcURLBase}},
+		{qname: "Status.SvcDiscovery.", expected: []string{"last_sdc_contact=never", "snapshot_routes=1"}},
+	}
+	for _, tc := range tests {
+		if txt := chaosTXT(t, sd, tc.qname); !reflect.DeepEqual(txt, tc.expected) {
+			t.Errorf("%s: expected %v, got %v", tc.qname, tc.expected, txt)
+		}
+	}
+
+	sdcc.record(nil)
+	lastContact := sdcc.status().LastContact.UTC().Format(time.RFC3339)
+	if txt := chaosTXT(t, sd, "status.svcdiscovery."); txt[0] != "last_sdc_contact="+lastContact {
+		t.Errorf("expected the last SDC contact at %s, got %v", lastContact, txt)
+	}
+}
+
+func TestServeDNSChaosACL(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/16")
+	sd := newTestServiceDiscovery()
+	sd.chaos = &chaosResponder{allow: []*net.IPNet{subnet}}
+
+	req := new(dns.Msg)
+	req.SetQuestion("version.svcdiscovery.", dns.TypeTXT)
+	req.Question[0].Qclass = dns.ClassCHAOS
+
+	// The test writer's client is 10.240.0.1.
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if code, _ := sd.ServeDNS(context.Background(), rec, req); code != dns.RcodeRefused {
+		t.Errorf("expected the question to be refused, got rcode %d", code)
+	}
+
+	sd.chaos = nil
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	if code, _ := sd.ServeDNS(context.Background(), rec, req); code != dns.RcodeRefused {
+		t.Errorf("expected the question to be refused without chaos_allow, got rcode %d", code)
+	}
+}
+
+func TestServeDNSChaosUnhandled(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.240.0.0/16")
+	sd := newTestServiceDiscovery()
+	sd.chaos = &chaosResponder{allow: []*net.IPNet{subnet}}
+
+	tests := []struct {
+		qname string
+		qtype uint16
+	}{
+		{qname: "hostname.bind.", qtype: dns.TypeTXT},
+		{qname: "version.svcdiscovery.", qtype: dns.TypeA},
+		{qname: "myapp.apps.internal.", qtype: dns.TypeA},
+	}
+	for _, tc := range tests {
+		req := new(dns.Msg)
+		req.SetQuestion(tc.qname, tc.qtype)
+		req.Question[0].Qclass = dns.ClassCHAOS
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if code, _ := sd.ServeDNS(context.Background(), rec, req); code != dns.RcodeRefused {
+			t.Errorf("%s: expected the question to be refused, got rcode %d", tc.qname, code)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Host tags set by the backends that know the app and instance of each host.
+const (
+	appGUIDTag       = "app_guid"
+	instanceIndexTag = "instance_index"
+)
+
+// Discoverer is the source of truth for the internal routes. The SDCClient is
+// the default implementation.
+type Discoverer interface {
+	// Discover returns the hosts registered for the internal route with the
+	// given fully qualified domain name. An empty list of hosts means that the
+	// route is unknown to the Discoverer.
+	Discover(ctx context.Context, domainName string) ([]Host, error)
+}
+
+// Lister is implemented by the Discoverers that can list all the internal
+// routes they know, as needed to serve zone transfers.
+type Lister interface {
+	// List returns the hosts registered for every internal route, keyed by the
+	// fully qualified domain name of the route.
+	List(ctx context.Context) (map[string][]Host, error)
+}
+
+// listRoutes lists the routes of the Discoverer, failing if it doesn't
+// implement Lister.
+func listRoutes(ctx context.Context, discoverer Discoverer) (map[string][]Host, error) {
+	lister, ok := discoverer.(Lister)
+	if !ok {
+		return nil, fmt.Errorf("discovery backend %T cannot list routes", discoverer)
+	}
+	return lister.List(ctx)
+}
+
+// Host represents a single host registered for an internal route. The JSON
+// representation matches the hosts returned by the Service Discovery
+// Controller.
+type Host struct {
+	IPAddress   string                 `json:"ip_address"`
+	LastCheckIn string                 `json:"last_check_in"`
+	Port        uint16                 `json:"port"`
+	Tags        map[string]interface{} `json:"tags"`
+}
+
+// Tag returns the string representation of the host tag with the given key.
+func (h Host) Tag(key string) (string, bool) {
+	v, ok := h.Tags[key]
+	if !ok || v == nil {
+		return "", false
+	}
+	return fmt.Sprint(v), true
+}
+
+// key identifies the host by its IP and port.
+func (h Host) key() string {
+	return h.IPAddress + ":" + strconv.FormatUint(uint64(h.Port), 10)
+}
+
+// lookupInfo collects information about the backend lookups made to answer a
+// request, for the components observing the requests.
+type lookupInfo struct {
+	mu sync.Mutex
+	// latency is the total time spent discovering hosts.
+	latency time.Duration
+	// sdcRequests are the requests made to the Service Discovery Controller.
+	sdcRequests []sdcRequest
+	// passed is set when the question is passed to the next plugin instead of
+	// being answered from a route.
+	passed bool
+}
+
+// sdcRequest describes a request made to the Service Discovery Controller.
+type sdcRequest struct {
+	URL string `json:"url"`
+	// Status is the HTTP status code of the response, or zero if no response
+	// was received.
+	Status  int     `json:"status"`
+	Latency float64 `json:"latency_ms"`
+}
+
+type lookupInfoKey struct{}
+
+// withLookupInfo returns a context collecting the information of the backend
+// lookups into the returned lookupInfo.
+func withLookupInfo(ctx context.Context) (context.Context, *lookupInfo) {
+	info := &lookupInfo{}
+	return context.WithValue(ctx, lookupInfoKey{}, info), info
+}
+
+// lookupInfoFrom returns the lookupInfo of the context, or nil if the lookups
+// are not observed.
+func lookupInfoFrom(ctx context.Context) *lookupInfo {
+	info, _ := ctx.Value(lookupInfoKey{}).(*lookupInfo)
+	return info
+}
+
+// addLatency adds the duration of a lookup. It's a no-op on nil.
+func (li *lookupInfo) addLatency(d time.Duration) {
+	if li == nil {
+		return
+	}
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	li.latency += d
+}
+
+// pass records that the question is passed to the next plugin. It's a no-op on
+// nil.
+func (li *lookupInfo) pass() {
+	if li == nil {
+		return
+	}
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	li.passed = true
+}
+
+// answered returns whether the question was answered by the plugin rather
+// than passed to the next plugin.
+func (li *lookupInfo) answered() bool {
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	return !li.passed
+}
+
+// addSDCRequest records a request made to the Service Discovery Controller.
+// It's a no-op on nil.
+func (li *lookupInfo) addSDCRequest(url string, status int, d time.Duration) {
+	if li == nil {
+		return
+	}
+	li.mu.Lock()
+	defer li.mu.Unlock()
+	li.sdcRequests = append(li.sdcRequests, sdcRequest{
+		URL:     url,
+		Status:  status,
+		Latency: float64(d) / float64(time.Millisecond),
+	})
+}
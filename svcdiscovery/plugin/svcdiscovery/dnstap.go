@@ -0,0 +1,107 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/dnstap"
+	"github.com/coredns/coredns/plugin/dnstap/msg"
+	"github.com/coredns/coredns/plugin/dnstap/taprw"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/request"
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+)
+
+// tapExtra is the extra data of the tapped client messages, encoded in JSON.
+type tapExtra struct {
+	SDCRequests []sdcRequest `json:"sdc_requests"`
+}
+
+// tapWriter stops the dnstap plugin from tapping the client messages when the
+// response is written for a lookup answered from a route, which tapLookup taps
+// instead. The responses of the next plugin are left to the dnstap plugin.
+type tapWriter struct {
+	dns.ResponseWriter
+	opt  *taprw.SendOption
+	info *lookupInfo
+}
+
+// WriteMsg satisfies dns.ResponseWriter.WriteMsg.
+func (w *tapWriter) WriteMsg(m *dns.Msg) error {
+	if w.info.answered() {
+		w.opt.Cq = false
+		w.opt.Cr = false
+	}
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+// tapLookup sends the client query and response of the route question to
+// dnstap, along with the requests made to the Service Discovery Controller to
+// answer it. The response is left out when the rcode is neither recorded nor
+// written by the server.
+func (sd *ServiceDiscovery) tapLookup(tapper dnstap.Dnstap, state request.Request, start time.Time, rcode int, rec *dnstest.Recorder, info *lookupInfo) {
+	info.mu.Lock()
+	extra, err := json.Marshal(tapExtra{SDCRequests: append([]sdcRequest{}, info.sdcRequests...)})
+	info.mu.Unlock()
+	if err != nil {
+		sd.log.Errorf("Failed to tap lookup: %v", err)
+		return
+	}
+
+	b := msg.New().Time(start).Addr(state.W.RemoteAddr())
+	if tapper.Pack() {
+		b.Msg(state.Req)
+	}
+	m, err := b.ToClientQuery()
+	if err != nil {
+		sd.log.Errorf("Failed to tap lookup: %v", err)
+		return
+	}
+	sendTap(tapper, m, extra)
+
+	res := rec.Msg
+	if res == nil {
+		if plugin.ClientWrite(rcode) {
+			return
+		}
+		// The server writes the error response.
+		res = new(dns.Msg).SetRcode(state.Req, rcode)
+	}
+	b.Time(time.Now())
+	if tapper.Pack() {
+		b.Msg(res)
+	}
+	m, err = b.ToClientResponse()
+	if err != nil {
+		sd.log.Errorf("Failed to tap lookup: %v", err)
+		return
+	}
+	sendTap(tapper, m, extra)
+}
+
+func sendTap(tapper dnstap.Dnstap, m *tap.Message, extra []byte) {
+	t := tap.Dnstap_MESSAGE
+	tapper.IO.Dnstap(tap.Dnstap{
+		Type:    &t,
+		Message: m,
+		Extra:   extra,
+	})
+}
@@ -0,0 +1,119 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/dnstap"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	tap "github.com/dnstap/golang-dnstap"
+	"github.com/miekg/dns"
+)
+
+// trapIO is a dnstap I/O routine keeping the sent payloads.
+type trapIO struct {
+	trap []tap.Dnstap
+}
+
+func (io *trapIO) Dnstap(payload tap.Dnstap) {
+	io.trap = append(io.trap, payload)
+}
+
+func TestServeDNSTap(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"hosts": [{"ip_address": "10.11.12.13"}]}`)
+	}))
+	defer server.Close()
+
+	sd := newTestServiceDiscovery()
+	sd.discoverer = &SDCClient{
+		httpClient: server.Client(),
+		sdcURLBase: server.URL + "/v1/registration/",
+	}
+	io := &trapIO{}
+	d := dnstap.Dnstap{Next: sd, IO: io, JoinRawMessage: true}
+
+	req := new(dns.Msg)
+	req.SetQuestion("myapp.apps.internal.", dns.TypeA)
+	if _, err := d.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), req); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(io.trap) != 2 {
+		t.Fatalf("expected a client query and a client response, got %d messages", len(io.trap))
+	}
+	for i, typ := range []tap.Message_Type{tap.Message_CLIENT_QUERY, tap.Message_CLIENT_RESPONSE} {
+		payload := io.trap[i]
+		if payload.Message.GetType() != typ {
+			t.Errorf("expected message %d to be a %v, got %v", i, typ, payload.Message.GetType())
+		}
+		var extra tapExtra
+		if err := json.Unmarshal(payload.Extra, &extra); err != nil {
+			t.Fatal(err)
+		}
+		if len(extra.SDCRequests) != 1 {
+			t.Fatalf("expected 1 SDC request, got %+v", extra.SDCRequests)
+		}
+		r := extra.SDCRequests[0]
+		if r.URL != server.URL+"/v1/registration/myapp.apps.internal." || r.Status != http.StatusOK {
+			t.Errorf("unexpected SDC request: %+v", r)
+		}
+	}
+
+	res := new(dns.Msg)
+	if err := res.Unpack(io.trap[1].Message.ResponseMessage); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Answer) != 1 {
+		t.Errorf("expected 1 answer in the tapped response, got %v", res.Answer)
+	}
+}
+
+func TestServeDNSTapPassed(t *testing.T) {
+	sd := newTestServiceDiscovery()
+	sd.Next = plugin.HandlerFunc(func(ctx context.Context, w dns.ResponseWriter, r *dns.Msg) (int, error) {
+		res := new(dns.Msg)
+		res.SetRcode(r, dns.RcodeNameError)
+		return dns.RcodeNameError, w.WriteMsg(res)
+	})
+	io := &trapIO{}
+	d := dnstap.Dnstap{Next: sd, IO: io, JoinRawMessage: true}
+
+	// The lookups passed to the next plugin are tapped by the dnstap plugin.
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, err := d.ServeDNS(context.Background(), dnstest.NewRecorder(&test.ResponseWriter{}), req); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(io.trap) != 2 {
+		t.Fatalf("expected a client query and a client response, got %d messages", len(io.trap))
+	}
+	for i, payload := range io.trap {
+		if payload.Extra != nil {
+			t.Errorf("expected message %d to be tapped by the dnstap plugin, got extra %s", i, payload.Extra)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+	"sigs.k8s.io/yaml"
+)
+
+const defaultFileReload = 5 * time.Second
+
+// FileDiscoverer discovers internal routes from a YAML or JSON file mapping
+// the route names to their hosts, e.g.:
+//
+//	myapp.apps.internal:
+//	- ip_address: 10.255.141.235
+//	  port: 8080
+//	  tags:
+//	    az: z1
+//
+// The file is reloaded when its modification time or size changes.
+type FileDiscoverer struct {
+	path   string
+	reload time.Duration
+	log    clog.P
+
+	mu     sync.RWMutex
+	routes map[string][]Host
+	mtime  time.Time
+	size   int64
+
+	stopCh chan struct{}
+}
+
+// NewFileDiscoverer creates a new FileDiscoverer and loads the file. The file
+// is only reloaded after the FileDiscoverer is started.
+func NewFileDiscoverer(path string, reload time.Duration) (*FileDiscoverer, error) {
+	fd := &FileDiscoverer{
+		path:   path,
+		reload: reload,
+		log:    clog.NewWithPlugin(pluginName),
+		stopCh: make(chan struct{}),
+	}
+	if err := fd.load(); err != nil {
+		return nil, err
+	}
+	return fd, nil
+}
+
+// Start starts reloading the file periodically.
+func (fd *FileDiscoverer) Start() error {
+	go func() {
+		ticker := time.NewTicker(fd.reload)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-fd.stopCh:
+				return
+			case <-ticker.C:
+				if err := fd.load(); err != nil {
+					fd.log.Error(err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops reloading the file.
+func (fd *FileDiscoverer) Stop() error {
+	close(fd.stopCh)
+	return nil
+}
+
+// Discover returns the hosts in the file for the internal route. It satisfies
+// Discoverer.Discover.
+func (fd *FileDiscoverer) Discover(_ context.Context, domainName string) ([]Host, error) {
+	fd.mu.RLock()
+	defer fd.mu.RUnlock()
+	return fd.routes[dns.Fqdn(strings.ToLower(domainName))], nil
+}
+
+// List returns all the routes in the file. It satisfies Lister.List.
+func (fd *FileDiscoverer) List(_ context.Context) (map[string][]Host, error) {
+	fd.mu.RLock()
+	defer fd.mu.RUnlock()
+	routes := make(map[string][]Host, len(fd.routes))
+	for name, hosts := range fd.routes {
+		routes[name] = hosts
+	}
+	return routes, nil
+}
+
+// load reads the file if it changed since it was last read.
+func (fd *FileDiscoverer) load() error {
+	stat, err := os.Stat(fd.path)
+	if err != nil {
+		return fmt.Errorf("failed to load routes file: %w", err)
+	}
+
+	fd.mu.RLock()
+	unchanged := fd.routes != nil && fd.mtime.Equal(stat.ModTime()) && fd.size == stat.Size()
+	fd.mu.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(fd.path)
+	if err != nil {
+		return fmt.Errorf("failed to load routes file: %w", err)
+	}
+	var file map[string][]Host
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to load routes file %s: %w", fd.path, err)
+	}
+	routes := make(map[string][]Host, len(file))
+	for name, hosts := range file {
+		routes[dns.Fqdn(strings.ToLower(name))] = hosts
+	}
+
+	fd.mu.Lock()
+	fd.routes = routes
+	fd.mtime = stat.ModTime()
+	fd.size = stat.Size()
+	fd.mu.Unlock()
+
+	fd.log.Infof("Loaded %d routes from %s", len(routes), fd.path)
+	return nil
+}
+
+// overrideDiscoverer answers from the override Discoverer when it knows the
+// route, falling back to the base Discoverer otherwise.
+type overrideDiscoverer struct {
+	override Discoverer
+	base     Discoverer
+}
+
+// Discover satisfies Discoverer.Discover.
+func (od *overrideDiscoverer) Discover(ctx context.Context, domainName string) ([]Host, error) {
+	hosts, err := od.override.Discover(ctx, domainName)
+	if err != nil || len(hosts) > 0 {
+		return hosts, err
+	}
+	return od.base.Discover(ctx, domainName)
+}
+
+// List returns the routes of the base Discoverer, replaced by the routes of
+// the override Discoverer. It satisfies Lister.List.
+func (od *overrideDiscoverer) List(ctx context.Context) (map[string][]Host, error) {
+	routes, err := listRoutes(ctx, od.base)
+	if err != nil {
+		return nil, err
+	}
+	overrides, err := listRoutes(ctx, od.override)
+	if err != nil {
+		return nil, err
+	}
+	for name, hosts := range overrides {
+		if len(hosts) > 0 {
+			routes[name] = hosts
+		}
+	}
+	return routes, nil
+}
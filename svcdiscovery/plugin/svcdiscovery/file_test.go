@@ -0,0 +1,84 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileDiscoverer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svcdiscovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "routes.yaml")
+	routes := `
+myapp.apps.internal:
+- ip_address: 10.11.12.13
+  port: 8080
+  tags:
+    az: z1
+`
+	if err := ioutil.WriteFile(path, []byte(routes), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	fd, err := NewFileDiscoverer(path, defaultFileReload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Host{{IPAddress: "10.11.12.13", Port: 8080, Tags: map[string]interface{}{"az": "z1"}}}
+
+	hosts, err := fd.Discover(context.Background(), "myapp.apps.internal.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("expected %+v, got %+v", expected, hosts)
+	}
+
+	// The file takes precedence over the base Discoverer when layered.
+	od := &overrideDiscoverer{override: fd, base: fakeRoutes}
+	if hosts, _ = od.Discover(context.Background(), "myapp.apps.internal."); !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("expected %+v, got %+v", expected, hosts)
+	}
+	if hosts, _ = od.Discover(context.Background(), "v6.apps.internal."); !reflect.DeepEqual(hosts, fakeRoutes["v6.apps.internal."]) {
+		t.Errorf("expected the base hosts, got %+v", hosts)
+	}
+
+	// A changed file is reloaded.
+	if err := ioutil.WriteFile(path, []byte(`{"other.apps.internal": [{"ip_address": "10.11.12.14"}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := fd.load(); err != nil {
+		t.Fatal(err)
+	}
+	if hosts, _ = fd.Discover(context.Background(), "myapp.apps.internal."); len(hosts) != 0 {
+		t.Errorf("expected no hosts after reload, got %+v", hosts)
+	}
+	if hosts, _ = fd.Discover(context.Background(), "other.apps.internal."); len(hosts) != 1 {
+		t.Errorf("expected 1 host after reload, got %+v", hosts)
+	}
+}
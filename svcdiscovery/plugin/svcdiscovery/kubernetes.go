@@ -0,0 +1,252 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	defaultK8sLabelSelector    = "cloudfoundry.org/source_type=APP"
+	defaultK8sRoutesAnnotation = "cloudfoundry.org/internal-routes"
+	k8sRouteIndex              = "route"
+	k8sAppGUIDLabel            = "cloudfoundry.org/app_guid"
+	k8sInformerResyncPeriod    = 5 * time.Minute
+	defaultK8sSyncTimeout      = time.Minute
+)
+
+// K8sDiscoverer discovers internal routes from the app pods in the Kubernetes
+// API, as found on Eirini-based deployments. The pods carry the internal routes
+// they serve in an annotation containing a JSON list in the same format as the
+// Eirini `cloudfoundry.org/routes` annotation, e.g.:
+//
+//	[{"hostname": "myapp.apps.internal", "port": 8080}]
+//
+// Only running and ready pods are discovered.
+type K8sDiscoverer struct {
+	informer         cache.SharedIndexInformer
+	routesAnnotation string
+	syncTimeout      time.Duration
+	stopCh           chan struct{}
+	stopOnce         sync.Once
+}
+
+// K8sDiscovererConfig is the configuration for a K8sDiscoverer.
+type K8sDiscovererConfig struct {
+	// Namespace restricts the watched pods to a single namespace. All the
+	// namespaces are watched when empty.
+	Namespace        string
+	LabelSelector    string
+	RoutesAnnotation string
+	// SyncTimeout bounds the wait for the initial list of pods. Defaults to a
+	// minute when zero.
+	SyncTimeout time.Duration
+}
+
+// newK8sClient creates a Kubernetes client from the kubeconfig file, or from
+// the in-cluster configuration if kubeconfigPath is empty.
+func newK8sClient(kubeconfigPath string) (kubernetes.Interface, error) {
+	var config *rest.Config
+	var err error
+	if kubeconfigPath == "" {
+		config, err = rest.InClusterConfig()
+	} else {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfigPath)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return kubernetes.NewForConfig(config)
+}
+
+// NewK8sDiscoverer creates a new K8sDiscoverer watching the pods with the
+// client. It must be started before use.
+func NewK8sDiscoverer(client kubernetes.Interface, config K8sDiscovererConfig) (*K8sDiscoverer, error) {
+	kd := &K8sDiscoverer{
+		routesAnnotation: config.RoutesAnnotation,
+		syncTimeout:      config.SyncTimeout,
+		stopCh:           make(chan struct{}),
+	}
+	if kd.syncTimeout == 0 {
+		kd.syncTimeout = defaultK8sSyncTimeout
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(
+		client,
+		k8sInformerResyncPeriod,
+		informers.WithNamespace(config.Namespace),
+		informers.WithTweakListOptions(func(opts *metav1.ListOptions) {
+			opts.LabelSelector = config.LabelSelector
+		}),
+	)
+	kd.informer = factory.Core().V1().Pods().Informer()
+	if err := kd.informer.AddIndexers(cache.Indexers{k8sRouteIndex: kd.routeIndexFunc}); err != nil {
+		return nil, fmt.Errorf("failed to create Kubernetes discoverer: %w", err)
+	}
+
+	return kd, nil
+}
+
+// Start starts watching the pods and blocks until the initial list of pods is
+// synced. It fails, and stops watching, when the pods are not synced within
+// the sync timeout, e.g. when the API server is unreachable.
+func (kd *K8sDiscoverer) Start() error {
+	go kd.informer.Run(kd.stopCh)
+
+	ctx, cancel := context.WithTimeout(context.Background(), kd.syncTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-kd.stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if !cache.WaitForCacheSync(ctx.Done(), kd.informer.HasSynced) {
+		kd.Stop()
+		return fmt.Errorf("failed to sync Kubernetes pods within %s", kd.syncTimeout)
+	}
+	return nil
+}
+
+// Stop stops watching the pods.
+func (kd *K8sDiscoverer) Stop() error {
+	kd.stopOnce.Do(func() { close(kd.stopCh) })
+	return nil
+}
+
+// Discover returns the hosts for the ready pods serving the internal route. It
+// satisfies Discoverer.Discover.
+func (kd *K8sDiscoverer) Discover(_ context.Context, domainName string) ([]Host, error) {
+	name := dns.Fqdn(strings.ToLower(domainName))
+	objs, err := kd.informer.GetIndexer().ByIndex(k8sRouteIndex, name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover service: %w", err)
+	}
+
+	hosts := make([]Host, 0, len(objs))
+	for _, obj := range objs {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok || !podReady(pod) {
+			continue
+		}
+		for _, route := range kd.podRoutes(pod) {
+			if route.name() != name {
+				continue
+			}
+			hosts = append(hosts, podHost(pod, route.Port))
+		}
+	}
+	return hosts, nil
+}
+
+// List returns the hosts for the ready pods of every internal route. It
+// satisfies Lister.List.
+func (kd *K8sDiscoverer) List(_ context.Context) (map[string][]Host, error) {
+	routes := make(map[string][]Host)
+	for _, obj := range kd.informer.GetIndexer().List() {
+		pod, ok := obj.(*corev1.Pod)
+		if !ok || !podReady(pod) {
+			continue
+		}
+		for _, route := range kd.podRoutes(pod) {
+			routes[route.name()] = append(routes[route.name()], podHost(pod, route.Port))
+		}
+	}
+	return routes, nil
+}
+
+// k8sRoute is an element of the routes annotation.
+type k8sRoute struct {
+	Hostname string `json:"hostname"`
+	Port     uint16 `json:"port"`
+}
+
+func (r k8sRoute) name() string {
+	return dns.Fqdn(strings.ToLower(r.Hostname))
+}
+
+func (kd *K8sDiscoverer) podRoutes(pod *corev1.Pod) []k8sRoute {
+	annotation, ok := pod.Annotations[kd.routesAnnotation]
+	if !ok {
+		return nil
+	}
+	var routes []k8sRoute
+	if err := json.Unmarshal([]byte(annotation), &routes); err != nil {
+		return nil
+	}
+	return routes
+}
+
+func (kd *K8sDiscoverer) routeIndexFunc(obj interface{}) ([]string, error) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return nil, nil
+	}
+	routes := kd.podRoutes(pod)
+	names := make([]string, len(routes))
+	for i, route := range routes {
+		names[i] = route.name()
+	}
+	return names, nil
+}
+
+func podReady(pod *corev1.Pod) bool {
+	if pod.Status.Phase != corev1.PodRunning || pod.Status.PodIP == "" || pod.DeletionTimestamp != nil {
+		return false
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// podHost converts the pod to a Host. The instance index is taken from the
+// ordinal of the StatefulSet pod name.
+func podHost(pod *corev1.Pod, port uint16) Host {
+	tags := make(map[string]interface{})
+	if guid, ok := pod.Labels[k8sAppGUIDLabel]; ok {
+		tags[appGUIDTag] = guid
+	}
+	if i := strings.LastIndexByte(pod.Name, '-'); i >= 0 {
+		if index, err := strconv.ParseUint(pod.Name[i+1:], 10, 32); err == nil {
+			tags[instanceIndexTag] = strconv.FormatUint(index, 10)
+		}
+	}
+	return Host{
+		IPAddress: pod.Status.PodIP,
+		Port:      port,
+		Tags:      tags,
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestPod(name, ip string, ready bool, routes string) *corev1.Pod {
+	status := corev1.ConditionFalse
+	if ready {
+		status = corev1.ConditionTrue
+	}
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "eirini",
+			Labels: map[string]string{
+				"cloudfoundry.org/source_type": "APP",
+				k8sAppGUIDLabel:                "app-guid",
+			},
+			Annotations: map[string]string{
+				defaultK8sRoutesAnnotation: routes,
+			},
+		},
+		Status: corev1.PodStatus{
+			Phase:      corev1.PodRunning,
+			PodIP:      ip,
+			Conditions: []corev1.PodCondition{{Type: corev1.PodReady, Status: status}},
+		},
+	}
+}
+
+func TestK8sDiscoverer(t *testing.T) {
+	client := fake.NewSimpleClientset(
+		newTestPod("myapp-0", "10.11.12.13", true, `[{"hostname": "myapp.apps.internal", "port": 8080}]`),
+		newTestPod("myapp-1", "10.11.12.14", false, `[{"hostname": "myapp.apps.internal", "port": 8080}]`),
+		newTestPod("other-0", "10.11.12.15", true, `[{"hostname": "other.apps.internal", "port": 8080}]`),
+	)
+
+	kd, err := NewK8sDiscoverer(client, K8sDiscovererConfig{
+		LabelSelector:    defaultK8sLabelSelector,
+		RoutesAnnotation: defaultK8sRoutesAnnotation,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer kd.Stop()
+
+	hosts, err := kd.Discover(context.Background(), "MyApp.apps.internal.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Host{{
+		IPAddress: "10.11.12.13",
+		Port:      8080,
+		Tags:      map[string]interface{}{appGUIDTag: "app-guid", instanceIndexTag: "0"},
+	}}
+	if !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("expected %+v, got %+v", expected, hosts)
+	}
+
+	// Pods are discovered as they are created.
+	pod := newTestPod("myapp-2", "10.11.12.16", true, `[{"hostname": "myapp.apps.internal", "port": 8080}]`)
+	if _, err := client.CoreV1().Pods("eirini").Create(context.Background(), pod, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(hosts) != 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		if hosts, err = kd.Discover(context.Background(), "myapp.apps.internal."); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(hosts) != 2 {
+		t.Errorf("expected 2 hosts after creating a pod, got %+v", hosts)
+	}
+
+	hosts, err = kd.Discover(context.Background(), "unknown.apps.internal.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 0 {
+		t.Errorf("expected no hosts, got %+v", hosts)
+	}
+}
+
+func TestK8sDiscovererSyncTimeout(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	// The pods can never be listed, as when the API server is unreachable.
+	client.PrependReactor("list", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("connection refused")
+	})
+
+	kd, err := NewK8sDiscoverer(client, K8sDiscovererConfig{
+		LabelSelector:    defaultK8sLabelSelector,
+		RoutesAnnotation: defaultK8sRoutesAnnotation,
+		SyncTimeout:      100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := kd.Start(); err == nil {
+		t.Fatal("expected the start to fail")
+	}
+	// Stopping after a failed start is a no-op.
+	if err := kd.Stop(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,130 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+const defaultLocalityTag = "az"
+
+// localityMode controls what is done with the hosts that are local to the
+// querying client.
+type localityMode int
+
+const (
+	// localityModeFilter answers only with the local hosts, as long as there are
+	// enough of them.
+	localityModeFilter localityMode = iota
+	// localityModeOrder answers with all the hosts, placing the local ones
+	// first.
+	localityModeOrder
+)
+
+func parseLocalityMode(s string) (localityMode, error) {
+	switch s {
+	case "filter":
+		return localityModeFilter, nil
+	case "order":
+		return localityModeOrder, nil
+	default:
+		return 0, fmt.Errorf("invalid locality mode: %s", s)
+	}
+}
+
+// locality prefers the discovered hosts that are in the same availability zone
+// as the querying client. The zone of a host is read from one of its SDC tags,
+// while the zone of the client is determined by matching its address against
+// the configured subnets.
+type locality struct {
+	tag      string
+	zones    []localityZone
+	mode     localityMode
+	minHosts int
+}
+
+// localityZone maps a client subnet to an availability zone.
+type localityZone struct {
+	subnet *net.IPNet
+	name   string
+}
+
+func newLocality() *locality {
+	return &locality{
+		tag:      defaultLocalityTag,
+		mode:     localityModeFilter,
+		minHosts: 1,
+	}
+}
+
+// clientZone returns the availability zone of the querying client. The address
+// carried by an EDNS Client Subnet option takes precedence over the source
+// address of the request.
+func (l *locality) clientZone(state request.Request) (string, bool) {
+	ip := net.ParseIP(state.IP())
+	if opt := state.Req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+				ip = subnet.Address
+				break
+			}
+		}
+	}
+	if ip == nil {
+		return "", false
+	}
+	for _, zone := range l.zones {
+		if zone.subnet.Contains(ip) {
+			return zone.name, true
+		}
+	}
+	return "", false
+}
+
+// apply filters or orders the hosts according to the zone of the querying
+// client. All the hosts are returned when the client zone is unknown or when
+// there are fewer local hosts than the configured minimum.
+func (l *locality) apply(state request.Request, hosts []Host) []Host {
+	zone, ok := l.clientZone(state)
+	if !ok {
+		return hosts
+	}
+
+	local := make([]Host, 0, len(hosts))
+	remote := make([]Host, 0, len(hosts))
+	for _, host := range hosts {
+		if hostZone, ok := host.Tag(l.tag); ok && hostZone == zone {
+			local = append(local, host)
+		} else {
+			remote = append(remote, host)
+		}
+	}
+
+	switch l.mode {
+	case localityModeOrder:
+		return append(local, remote...)
+	default:
+		if len(local) < l.minHosts {
+			return hosts
+		}
+		return local
+	}
+}
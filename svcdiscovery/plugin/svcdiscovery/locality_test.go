@@ -0,0 +1,81 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+func TestLocality(t *testing.T) {
+	z1a := Host{IPAddress: "10.11.12.13", Tags: map[string]interface{}{"az": "z1"}}
+	z1b := Host{IPAddress: "10.11.12.14", Tags: map[string]interface{}{"az": "z1"}}
+	z2 := Host{IPAddress: "10.11.12.15", Tags: map[string]interface{}{"az": "z2"}}
+	untagged := Host{IPAddress: "10.11.12.16"}
+	hosts := []Host{z1a, z2, untagged, z1b}
+
+	// The test writer's client is 10.240.0.1.
+	_, z1Subnet, _ := net.ParseCIDR("10.240.0.0/16")
+	_, z2Subnet, _ := net.ParseCIDR("192.168.0.0/16")
+
+	tests := []struct {
+		name     string
+		mode     localityMode
+		minHosts int
+		// ecs is the address of the EDNS Client Subnet option, if any.
+		ecs      string
+		expected []Host
+	}{
+		{name: "filter", mode: localityModeFilter, minHosts: 1, expected: []Host{z1a, z1b}},
+		{name: "filter with enough local hosts", mode: localityModeFilter, minHosts: 2, expected: []Host{z1a, z1b}},
+		{name: "filter with too few local hosts", mode: localityModeFilter, minHosts: 3, expected: hosts},
+		{name: "order", mode: localityModeOrder, minHosts: 1, expected: []Host{z1a, z1b, z2, untagged}},
+		{name: "client subnet over source", mode: localityModeFilter, minHosts: 1, ecs: "192.168.1.1", expected: []Host{z2}},
+		{name: "unknown client zone", mode: localityModeFilter, minHosts: 1, ecs: "172.16.0.1", expected: hosts},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLocality()
+			l.zones = []localityZone{{subnet: z1Subnet, name: "z1"}, {subnet: z2Subnet, name: "z2"}}
+			l.mode = tt.mode
+			l.minHosts = tt.minHosts
+
+			req := new(dns.Msg)
+			req.SetQuestion("myapp.apps.internal.", dns.TypeA)
+			if tt.ecs != "" {
+				req.SetEdns0(4096, false)
+				req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_SUBNET{
+					Code:          dns.EDNS0SUBNET,
+					Family:        1,
+					SourceNetmask: 32,
+					Address:       net.ParseIP(tt.ecs),
+				})
+			}
+			state := request.Request{W: &test.ResponseWriter{}, Req: req}
+
+			if got := l.apply(state, append([]Host{}, hosts...)); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
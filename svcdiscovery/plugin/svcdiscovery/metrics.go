@@ -0,0 +1,56 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"github.com/coredns/coredns/plugin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Variables declared for monitoring.
+var (
+	StaleHostsCount = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "stale_hosts_total",
+		Help:      "Counter of discovered hosts filtered out for not checking in recently.",
+	})
+	RejectedAddressesCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "rejected_addresses_total",
+		Help:      "Counter of discovered host addresses rejected from the answers.",
+	}, []string{"reason"})
+	ShadowComparisonsCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "shadow_comparisons_total",
+		Help:      "Counter of comparisons between the primary and the shadow backend answers.",
+	}, []string{"result"})
+	RateLimitedCount = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "rate_limited_requests_total",
+		Help:      "Counter of requests exceeding the client rate limit.",
+	}, []string{"action"})
+	RateLimitedTopClients = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: plugin.Namespace,
+		Subsystem: pluginName,
+		Name:      "rate_limited_top_clients",
+		Help:      "Gauge of the requests exceeding the rate limit over the last window, for the top offending clients.",
+	}, []string{"client"})
+)
@@ -0,0 +1,108 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// wildcards maps the zones of the wildcard routes, e.g. team.apps.internal for
+// *.team.apps.internal, to the route registration answering for them.
+type wildcards map[string]string
+
+// match returns the registration of the longest wildcard route matching
+// name, or an empty string if none does.
+func (w wildcards) match(name string) string {
+	name = strings.ToLower(name)
+	longest := ""
+	for zone := range w {
+		if name != zone && dns.IsSubDomain(zone, name) && len(zone) > len(longest) {
+			longest = zone
+		}
+	}
+	if longest == "" {
+		return ""
+	}
+	return w[longest]
+}
+
+// defaultInternalZone is the zone of the internal names when no zone is owned.
+const defaultInternalZone = "internal."
+
+// discover discovers the hosts of the route name. When the route is unknown,
+// the name is tried as an instance-index name, e.g. 0.myapp.apps.internal for
+// the instance 0 of myapp.apps.internal, and then against the wildcard routes.
+// It returns the route registration the hosts were discovered for.
+func (sd *ServiceDiscovery) discover(ctx context.Context, name string) (string, []Host, error) {
+	hosts, err := sd.discoverer.Discover(ctx, name)
+	if err != nil || len(hosts) > 0 {
+		return name, hosts, err
+	}
+
+	if index, parent, ok := sd.instanceName(name); ok {
+		route := parent
+		hosts, err := sd.discoverer.Discover(ctx, parent)
+		if err == nil && len(hosts) == 0 {
+			if registration := sd.wildcards.match(parent); registration != "" {
+				route = registration
+				hosts, err = sd.discoverer.Discover(ctx, registration)
+			}
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		instances := make([]Host, 0, 1)
+		for _, host := range hosts {
+			if v, ok := host.Tag(sd.instanceTag); ok {
+				if i, err := strconv.ParseUint(v, 10, 32); err == nil && i == index {
+					instances = append(instances, host)
+				}
+			}
+		}
+		if len(instances) > 0 {
+			return route, instances, nil
+		}
+	}
+
+	if registration := sd.wildcards.match(name); registration != "" {
+		hosts, err := sd.discoverer.Discover(ctx, registration)
+		return registration, hosts, err
+	}
+	return name, nil, nil
+}
+
+// instanceName splits an instance-index name under an internal zone into the
+// instance index and the route name. Only the leading label is an index, the
+// route name is never split again.
+func (sd *ServiceDiscovery) instanceName(name string) (uint64, string, bool) {
+	if sd.instanceTag == "" || !sd.internal(name) {
+		return 0, "", false
+	}
+	i := strings.IndexByte(name, '.')
+	if i <= 0 || i == len(name)-1 {
+		return 0, "", false
+	}
+	index, err := strconv.ParseUint(name[:i], 10, 32)
+	if err != nil {
+		return 0, "", false
+	}
+	return index, name[i+1:], true
+}
@@ -0,0 +1,292 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	natsRegisterSubject   = "service-discovery.register"
+	natsUnregisterSubject = "service-discovery.unregister"
+	natsGreetSubject      = "service-discovery.greet"
+	natsStartSubject      = "service-discovery.start"
+
+	defaultNATSStaleness        = 2 * time.Minute
+	defaultNATSPruneInterval    = 3 * time.Second
+	defaultNATSRegisterInterval = 20 * time.Second
+)
+
+// NATSDiscoverer discovers internal routes by subscribing to the route
+// registration messages published on NATS, the same way the SDC builds its
+// routes table. Registrations that are not refreshed within the staleness
+// threshold are pruned.
+type NATSDiscoverer struct {
+	urls    []string
+	options []nats.Option
+	config  NATSDiscovererConfig
+	log     clog.P
+
+	conn   *nats.Conn
+	stopCh chan struct{}
+
+	mu     sync.RWMutex
+	routes map[string]map[string]natsEntry
+}
+
+// NATSDiscovererConfig is the configuration for a NATSDiscoverer.
+type NATSDiscovererConfig struct {
+	// Staleness is the time after which a registration that was not refreshed
+	// is pruned.
+	Staleness time.Duration
+	// PruneInterval is the interval for pruning stale registrations.
+	PruneInterval time.Duration
+	// RegisterInterval is the interval the route emitters are asked to refresh
+	// their registrations at.
+	RegisterInterval time.Duration
+}
+
+// natsEntry is a registered host for a route.
+type natsEntry struct {
+	host    Host
+	updated time.Time
+}
+
+// natsRegistration is the message published by the route emitters on the
+// register and unregister subjects.
+type natsRegistration struct {
+	Host                 string                 `json:"host"`
+	Port                 uint16                 `json:"port"`
+	URIs                 []string               `json:"uris"`
+	Tags                 map[string]interface{} `json:"tags"`
+	App                  string                 `json:"app"`
+	PrivateInstanceIndex string                 `json:"private_instance_index"`
+}
+
+// natsStart is the message published on the start subject and replied to
+// greetings, advertising the registration intervals expected by the
+// subscriber.
+type natsStart struct {
+	MinimumRegisterIntervalInSeconds int `json:"minimumRegisterIntervalInSeconds"`
+	PruneThresholdInSeconds          int `json:"pruneThresholdInSeconds"`
+}
+
+// NewNATSDiscoverer creates a new NATSDiscoverer for the NATS servers. It must
+// be started before use.
+func NewNATSDiscoverer(urls []string, config NATSDiscovererConfig, options ...nats.Option) *NATSDiscoverer {
+	return &NATSDiscoverer{
+		urls:    urls,
+		options: options,
+		config:  config,
+		log:     clog.NewWithPlugin(pluginName),
+		stopCh:  make(chan struct{}),
+		routes:  make(map[string]map[string]natsEntry),
+	}
+}
+
+// Start connects to NATS, subscribes to the registration subjects and starts
+// pruning stale registrations.
+func (nd *NATSDiscoverer) Start() error {
+	options := append([]nats.Option{
+		nats.Name("kubecf-apps-dns"),
+		nats.MaxReconnects(-1),
+	}, nd.options...)
+	conn, err := nats.Connect(strings.Join(nd.urls, ","), options...)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS: %w", err)
+	}
+	nd.conn = conn
+
+	if _, err := conn.Subscribe(natsRegisterSubject, nd.handleRegister); err != nil {
+		return fmt.Errorf("failed to subscribe to NATS: %w", err)
+	}
+	if _, err := conn.Subscribe(natsUnregisterSubject, nd.handleUnregister); err != nil {
+		return fmt.Errorf("failed to subscribe to NATS: %w", err)
+	}
+	if _, err := conn.Subscribe(natsGreetSubject, nd.handleGreet); err != nil {
+		return fmt.Errorf("failed to subscribe to NATS: %w", err)
+	}
+	// Ask the route emitters to register all the routes right away instead of
+	// waiting for their next refresh.
+	if err := conn.Publish(natsStartSubject, nd.startMessage()); err != nil {
+		return fmt.Errorf("failed to publish to NATS: %w", err)
+	}
+
+	go func() {
+		ticker := time.NewTicker(nd.config.PruneInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-nd.stopCh:
+				return
+			case now := <-ticker.C:
+				nd.prune(now)
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Stop disconnects from NATS and stops pruning.
+func (nd *NATSDiscoverer) Stop() error {
+	close(nd.stopCh)
+	if nd.conn != nil {
+		nd.conn.Close()
+	}
+	return nil
+}
+
+// Discover returns the hosts registered for the internal route. It satisfies
+// Discoverer.Discover.
+func (nd *NATSDiscoverer) Discover(_ context.Context, domainName string) ([]Host, error) {
+	nd.mu.RLock()
+	defer nd.mu.RUnlock()
+	entries := nd.routes[dns.Fqdn(strings.ToLower(domainName))]
+	hosts := make([]Host, 0, len(entries))
+	for _, entry := range entries {
+		host := entry.host
+		host.LastCheckIn = entry.updated.UTC().Format(time.RFC3339Nano)
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// List returns the hosts registered for every internal route. It satisfies
+// Lister.List.
+func (nd *NATSDiscoverer) List(_ context.Context) (map[string][]Host, error) {
+	nd.mu.RLock()
+	defer nd.mu.RUnlock()
+	routes := make(map[string][]Host, len(nd.routes))
+	for name, entries := range nd.routes {
+		for _, entry := range entries {
+			host := entry.host
+			host.LastCheckIn = entry.updated.UTC().Format(time.RFC3339Nano)
+			routes[name] = append(routes[name], host)
+		}
+	}
+	return routes, nil
+}
+
+func (nd *NATSDiscoverer) handleRegister(msg *nats.Msg) {
+	var registration natsRegistration
+	if err := json.Unmarshal(msg.Data, &registration); err != nil {
+		nd.log.Warningf("Invalid NATS registration message: %v", err)
+		return
+	}
+	nd.register(registration, time.Now())
+}
+
+func (nd *NATSDiscoverer) handleUnregister(msg *nats.Msg) {
+	var registration natsRegistration
+	if err := json.Unmarshal(msg.Data, &registration); err != nil {
+		nd.log.Warningf("Invalid NATS unregistration message: %v", err)
+		return
+	}
+	nd.unregister(registration)
+}
+
+func (nd *NATSDiscoverer) handleGreet(msg *nats.Msg) {
+	if msg.Reply == "" {
+		return
+	}
+	if err := nd.conn.Publish(msg.Reply, nd.startMessage()); err != nil {
+		nd.log.Warningf("Failed to reply to NATS greeting: %v", err)
+	}
+}
+
+func (nd *NATSDiscoverer) startMessage() []byte {
+	data, _ := json.Marshal(natsStart{
+		MinimumRegisterIntervalInSeconds: int(nd.config.RegisterInterval.Seconds()),
+		PruneThresholdInSeconds:          int(nd.config.Staleness.Seconds()),
+	})
+	return data
+}
+
+func (nd *NATSDiscoverer) register(registration natsRegistration, now time.Time) {
+	tags := make(map[string]interface{}, len(registration.Tags)+2)
+	for k, v := range registration.Tags {
+		tags[k] = v
+	}
+	if registration.App != "" {
+		tags[appGUIDTag] = registration.App
+	}
+	if registration.PrivateInstanceIndex != "" {
+		tags[instanceIndexTag] = registration.PrivateInstanceIndex
+	}
+	entry := natsEntry{
+		host: Host{
+			IPAddress: registration.Host,
+			Port:      registration.Port,
+			Tags:      tags,
+		},
+		updated: now,
+	}
+
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+	for _, uri := range registration.URIs {
+		name := dns.Fqdn(strings.ToLower(uri))
+		if nd.routes[name] == nil {
+			nd.routes[name] = make(map[string]natsEntry)
+		}
+		nd.routes[name][registration.key()] = entry
+	}
+}
+
+func (nd *NATSDiscoverer) unregister(registration natsRegistration) {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+	for _, uri := range registration.URIs {
+		name := dns.Fqdn(strings.ToLower(uri))
+		delete(nd.routes[name], registration.key())
+		if len(nd.routes[name]) == 0 {
+			delete(nd.routes, name)
+		}
+	}
+}
+
+// prune removes the registrations that were not refreshed within the staleness
+// threshold.
+func (nd *NATSDiscoverer) prune(now time.Time) {
+	nd.mu.Lock()
+	defer nd.mu.Unlock()
+	for name, entries := range nd.routes {
+		for key, entry := range entries {
+			if now.Sub(entry.updated) > nd.config.Staleness {
+				delete(entries, key)
+			}
+		}
+		if len(entries) == 0 {
+			delete(nd.routes, name)
+		}
+	}
+}
+
+func (r natsRegistration) key() string {
+	return r.Host + ":" + strconv.FormatUint(uint64(r.Port), 10)
+}
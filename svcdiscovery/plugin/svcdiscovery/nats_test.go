@@ -0,0 +1,111 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/test"
+	"github.com/nats-io/nats.go"
+)
+
+func TestNATSDiscoverer(t *testing.T) {
+	opts := natsserver.DefaultTestOptions
+	opts.Port = -1
+	server := natsserver.RunServer(&opts)
+	defer server.Shutdown()
+
+	nd := NewNATSDiscoverer([]string{server.ClientURL()}, NATSDiscovererConfig{
+		Staleness:        defaultNATSStaleness,
+		PruneInterval:    defaultNATSPruneInterval,
+		RegisterInterval: defaultNATSRegisterInterval,
+	})
+	if err := nd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer nd.Stop()
+
+	emitter, err := nats.Connect(server.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer emitter.Close()
+
+	// The subscriber replies to greetings with the registration intervals.
+	reply, err := emitter.Request(natsGreetSubject, nil, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var start natsStart
+	if err := json.Unmarshal(reply.Data, &start); err != nil {
+		t.Fatal(err)
+	}
+	if start.PruneThresholdInSeconds != int(defaultNATSStaleness.Seconds()) {
+		t.Errorf("unexpected start message: %+v", start)
+	}
+
+	publish := func(subject string, registration natsRegistration) {
+		data, _ := json.Marshal(registration)
+		if err := emitter.Publish(subject, data); err != nil {
+			t.Fatal(err)
+		}
+		if err := emitter.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForHosts := func(name string, count int) []Host {
+		var hosts []Host
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			hosts, _ = nd.Discover(context.Background(), name)
+			if len(hosts) == count {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if len(hosts) != count {
+			t.Fatalf("expected %d hosts for %s, got %+v", count, name, hosts)
+		}
+		return hosts
+	}
+
+	registration := natsRegistration{
+		Host:                 "10.11.12.13",
+		URIs:                 []string{"myapp.apps.internal", "alias.apps.internal"},
+		PrivateInstanceIndex: "0",
+	}
+	publish(natsRegisterSubject, registration)
+	hosts := waitForHosts("myapp.apps.internal.", 1)
+	if hosts[0].IPAddress != "10.11.12.13" || hosts[0].LastCheckIn == "" {
+		t.Errorf("unexpected host: %+v", hosts[0])
+	}
+	if index, _ := hosts[0].Tag(instanceIndexTag); index != "0" {
+		t.Errorf("unexpected instance index: %q", index)
+	}
+	waitForHosts("alias.apps.internal.", 1)
+
+	publish(natsUnregisterSubject, registration)
+	waitForHosts("myapp.apps.internal.", 0)
+
+	// Registrations that are not refreshed are pruned.
+	nd.register(registration, time.Now().Add(-2*defaultNATSStaleness))
+	nd.prune(time.Now())
+	waitForHosts("alias.apps.internal.", 0)
+}
@@ -19,8 +19,12 @@ package svcdiscovery
 import (
 	"context"
 	"net"
+	"time"
 
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/dnstap"
+	"github.com/coredns/coredns/plugin/dnstap/taprw"
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
 	"github.com/coredns/coredns/request"
 	"github.com/miekg/dns"
@@ -31,9 +35,31 @@ import (
 type ServiceDiscovery struct {
 	Next plugin.Handler
 
-	log       clog.P
-	sdcClient *SDCClient
-	ttl       uint32
+	log        clog.P
+	discoverer Discoverer
+	ttl        *ttlPolicy
+	locality   *locality
+	staleness  *staleness
+	addresses  *addressFilter
+	synthesis  *ipv6Synthesis
+	aliases    *aliases
+	wildcards  wildcards
+	zones      *zoneAuthority
+	acl        *accessControl
+	policy     *policyFilter
+	rateLimit  *rateLimiter
+	audit      *auditLog
+	// instanceTag is the host tag matched against the instance index of the
+	// instance-index names. They are not resolved when it's empty.
+	instanceTag string
+	// alpnTag is the host tag listing the ALPN protocols of the SVCB and HTTPS
+	// records.
+	alpnTag string
+	// transferAllow restricts the zone transfers to the clients in the subnets.
+	transferAllow []*net.IPNet
+	// chaos answers the CHAOS TXT introspection questions. They are refused
+	// when it's nil.
+	chaos *chaosResponder
 }
 
 // Name satisfies plugin.Handler.Name.
@@ -50,15 +76,29 @@ func (sd *ServiceDiscovery) ServeDNS(
 	qtype := req.Question[0].Qtype
 	qname := req.Question[0].Name
 
-	if qclass == dns.ClassINET && (qtype == dns.TypeA || qtype == dns.TypeAAAA) {
-		ips, err := sd.sdcClient.Discover(ctx, qname)
-		if err != nil {
-			sd.log.Error(err)
-			return dns.RcodeServerFailure, err
+	// The server lets the other classes through in every server block once one
+	// of them answers the CHAOS questions, so the questions not answered here
+	// are refused rather than passed to the next plugins.
+	if qclass != dns.ClassINET {
+		if sd.chaos != nil && sd.chaos.answers(qclass, qtype, qname) {
+			return sd.serveChaos(rw, req)
+		}
+		return dns.RcodeRefused, nil
+	}
+
+	// The transfers themselves are served by the transfer plugin, which calls
+	// back into Transfer, once the client is known to be allowed.
+	if (qtype == dns.TypeAXFR || qtype == dns.TypeIXFR) && sd.ownedZone(qname) != "" {
+		state := request.Request{W: rw, Req: req}
+		if !sd.transferAllowed(state) {
+			sd.log.Warningf("%s: refused zone transfer to %s", qname, state.IP())
+			return dns.RcodeRefused, nil
 		}
+	}
 
-		if len(ips) > 0 {
-			if err := sd.respond(rw, req, ips); err != nil {
+	if qclass == dns.ClassINET && (qtype == dns.TypeSOA || qtype == dns.TypeNS) && sd.zones != nil {
+		if zone := dns.CanonicalName(qname); sd.zones.owns(zone) {
+			if err := sd.serveApex(ctx, rw, req, zone); err != nil {
 				sd.log.Error(err)
 				return dns.RcodeServerFailure, err
 			}
@@ -66,10 +106,198 @@ func (sd *ServiceDiscovery) ServeDNS(
 		}
 	}
 
+	if qclass == dns.ClassINET && answersFromHosts(qtype) {
+		audited := sd.audit != nil && sd.audit.sampled()
+		tapper, tapped := dnstap.TapperFromContext(ctx).(dnstap.Dnstap)
+		if audited || tapped {
+			return sd.serveObserved(ctx, rw, req, audited, tapper)
+		}
+		return sd.serveRoute(ctx, rw, req)
+	}
+
 	return plugin.NextOrFailure(pluginName, sd.Next, ctx, rw, req)
 }
 
-func (sd *ServiceDiscovery) respond(rw dns.ResponseWriter, req *dns.Msg, ips []string) error {
+// serveObserved serves the route question while recording the response and the
+// backend lookups, for the audit log when audited and for dnstap when the
+// tapper has an I/O routine.
+func (sd *ServiceDiscovery) serveObserved(ctx context.Context, rw dns.ResponseWriter, req *dns.Msg, audited bool, tapper dnstap.Dnstap) (int, error) {
+	start := time.Now()
+	ctx, info := withLookupInfo(ctx)
+	w := rw
+	// The client messages of the lookups answered from a route are tapped
+	// here instead of by the dnstap plugin, in order to carry the SDC
+	// requests.
+	opt, _ := ctx.Value(dnstap.DnstapSendOption).(*taprw.SendOption)
+	if tapper.IO != nil && opt != nil {
+		w = &tapWriter{ResponseWriter: rw, opt: opt, info: info}
+	}
+	rec := dnstest.NewRecorder(w)
+	rcode, err := sd.serveRoute(ctx, rec, req)
+
+	state := request.Request{W: rw, Req: req}
+	answered := info.answered()
+	// The external names passed to the upstream servers are not audited.
+	if audited && (answered || sd.internal(state.Name())) {
+		sd.auditLookup(state, rcode, rec, info)
+	}
+	if tapper.IO != nil && answered {
+		if opt != nil {
+			// The server may still write the error response.
+			opt.Cq = false
+			opt.Cr = false
+		}
+		sd.tapLookup(tapper, state, start, rcode, rec, info)
+	}
+	return rcode, err
+}
+
+// serveRoute answers the questions for an internal route from its hosts,
+// passing the unknown routes to the next plugin.
+func (sd *ServiceDiscovery) serveRoute(ctx context.Context, rw dns.ResponseWriter, req *dns.Msg) (int, error) {
+	qname := req.Question[0].Name
+
+	if sd.acl != nil {
+		state := request.Request{W: rw, Req: req}
+		if denied, ok := sd.acl.allowedAll(net.ParseIP(state.IP()), qname); !ok {
+			return sd.refuse(rw, req, denied)
+		}
+	}
+
+	if sd.rateLimit != nil {
+		state := request.Request{W: rw, Req: req}
+		if !sd.rateLimit.allow(state.IP(), state.Name(), time.Now()) {
+			sd.log.Debugf("%s: rate limited %s", qname, state.IP())
+			if sd.rateLimit.action == rateLimitRefuse || state.Proto() == "tcp" {
+				return dns.RcodeRefused, nil
+			}
+			res := &dns.Msg{}
+			res.SetReply(req)
+			res.Truncated = true
+			if err := rw.WriteMsg(res); err != nil {
+				sd.log.Error(err)
+				return dns.RcodeServerFailure, err
+			}
+			return dns.RcodeSuccess, nil
+		}
+	}
+
+	res, err := sd.resolve(ctx, qname)
+	if err != nil {
+		sd.log.Error(err)
+		return dns.RcodeServerFailure, err
+	}
+	name, chain, hosts := res.name, res.chain, res.hosts
+
+	// The aliases, instance-index and wildcard names must not give access to
+	// denied routes.
+	if sd.acl != nil {
+		state := request.Request{W: rw, Req: req}
+		if denied, ok := sd.acl.allowedAll(net.ParseIP(state.IP()), res.names()...); !ok {
+			return sd.refuse(rw, req, denied)
+		}
+	}
+
+	hosts = sd.usable(name, hosts)
+
+	if sd.policy != nil && len(hosts) > 0 {
+		state := request.Request{W: rw, Req: req}
+		if hosts, err = sd.policy.filter(ctx, state.IP(), hosts, time.Now()); err != nil {
+			sd.log.Error(err)
+			return dns.RcodeServerFailure, err
+		}
+	}
+
+	if len(hosts) > 0 || len(chain) > 0 {
+		if sd.locality != nil {
+			hosts = sd.locality.apply(request.Request{W: rw, Req: req}, hosts)
+		}
+		if err := sd.respond(rw, req, name, chain, hosts); err != nil {
+			sd.log.Error(err)
+			return dns.RcodeServerFailure, err
+		}
+		return dns.RcodeSuccess, nil
+	}
+
+	lookupInfoFrom(ctx).pass()
+	return plugin.NextOrFailure(pluginName, sd.Next, ctx, rw, req)
+}
+
+// answersFromHosts returns whether the questions of the type are answered from
+// the hosts of the route.
+func answersFromHosts(qtype uint16) bool {
+	switch qtype {
+	case dns.TypeA, dns.TypeAAAA, dns.TypeSVCB, dns.TypeHTTPS:
+		return true
+	}
+	return false
+}
+
+// ownedZone returns the owned zone containing qname, if any.
+func (sd *ServiceDiscovery) ownedZone(qname string) string {
+	if sd.zones == nil {
+		return ""
+	}
+	return sd.zones.owner(dns.CanonicalName(qname))
+}
+
+// internal returns whether qname is under an owned zone or, without any, under
+// the internal TLD used by the Cloud Foundry internal domains.
+func (sd *ServiceDiscovery) internal(qname string) bool {
+	if sd.zones != nil {
+		return sd.ownedZone(qname) != ""
+	}
+	return dns.IsSubDomain(defaultInternalZone, dns.CanonicalName(qname))
+}
+
+// usable drops the hosts that are invalid or stale.
+func (sd *ServiceDiscovery) usable(qname string, hosts []Host) []Host {
+	hosts = sd.validate(qname, hosts)
+
+	if sd.staleness != nil {
+		var dropped int
+		hosts, dropped = sd.staleness.filter(hosts, time.Now())
+		if dropped > 0 {
+			StaleHostsCount.Add(float64(dropped))
+			sd.log.Debugf("%s: dropped %d stale hosts", qname, dropped)
+		}
+	}
+
+	return hosts
+}
+
+// usableHosts drops the hosts that are invalid or stale like usable, without
+// counting nor logging them, for building the zones outside of any answer.
+func (sd *ServiceDiscovery) usableHosts(hosts []Host) []Host {
+	valid := make([]Host, 0, len(hosts))
+	for _, host := range hosts {
+		if sd.addresses.check(host.IPAddress) == "" {
+			valid = append(valid, host)
+		}
+	}
+	if sd.staleness != nil {
+		valid, _ = sd.staleness.filter(valid, time.Now())
+	}
+	return valid
+}
+
+// validate drops the hosts with addresses that must not be used in an answer.
+func (sd *ServiceDiscovery) validate(qname string, hosts []Host) []Host {
+	valid := make([]Host, 0, len(hosts))
+	for _, host := range hosts {
+		if reason := sd.addresses.check(host.IPAddress); reason != "" {
+			RejectedAddressesCount.WithLabelValues(reason).Inc()
+			sd.log.Warningf("%s: rejected address %q: %s", qname, host.IPAddress, reason)
+			continue
+		}
+		valid = append(valid, host)
+	}
+	return valid
+}
+
+// respond answers with the CNAME chain, if any, followed by the records of
+// the hosts discovered for name.
+func (sd *ServiceDiscovery) respond(rw dns.ResponseWriter, req *dns.Msg, name string, chain []dns.RR, hosts []Host) error {
 	state := request.Request{W: rw, Req: req}
 	qtype := state.QType()
 	qname := state.Name()
@@ -78,32 +306,54 @@ func (sd *ServiceDiscovery) respond(rw dns.ResponseWriter, req *dns.Msg, ips []s
 	res.SetReply(req)
 	res.Authoritative = true
 
-	answer := make([]dns.RR, 0, len(ips))
-	for _, ipStr := range ips {
-		ip := net.ParseIP(ipStr)
+	ttl := sd.ttl.answer(name, hosts)
+	answer := make([]dns.RR, 0, len(chain)+len(hosts))
+	answer = append(answer, chain...)
+	for _, host := range hosts {
+		ip := net.ParseIP(host.IPAddress)
 		if qtype == dns.TypeA && ip.To4() != nil {
 			answer = append(answer, &dns.A{
 				Hdr: dns.RR_Header{
-					Name:   qname,
+					Name:   name,
 					Rrtype: dns.TypeA,
 					Class:  dns.ClassINET,
-					Ttl:    sd.ttl,
+					Ttl:    ttl,
 				},
 				A: ip,
 			})
 		} else if qtype == dns.TypeAAAA && ip.To16() != nil {
+			if ip.To4() != nil {
+				if ip = sd.synthesis.synthesise(ip); ip == nil {
+					continue
+				}
+			}
 			answer = append(answer, &dns.AAAA{
 				Hdr: dns.RR_Header{
-					Name:   qname,
+					Name:   name,
 					Rrtype: dns.TypeAAAA,
 					Class:  dns.ClassINET,
-					Ttl:    sd.ttl,
+					Ttl:    ttl,
 				},
 				AAAA: ip,
 			})
 		}
 	}
+	if qtype == dns.TypeSVCB || qtype == dns.TypeHTTPS {
+		answer = append(answer, sd.serviceBindings(qtype, name, ttl, hosts)...)
+	}
 	res.Answer = answer
+	if len(answer) == 0 {
+		if zone := sd.ownedZone(qname); zone != "" {
+			soa := sd.zoneSOA(zone, sd.zones.current(zone, time.Now()))
+			// RFC 2308: the SOA TTL is the lower of its TTL and minimum TTL.
+			if soa.Minttl < soa.Hdr.Ttl {
+				soa.Hdr.Ttl = soa.Minttl
+			}
+			res.Ns = []dns.RR{soa}
+		} else if soa := sd.ttl.negativeSOA(qname); soa != nil {
+			res.Ns = []dns.RR{soa}
+		}
+	}
 
 	sd.log.Debugf("%s: %+v\n", qname, answer)
 
@@ -0,0 +1,353 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+// fakeDiscoverer is an in-process Discoverer serving a static route table,
+// keyed by canonical names. It fails for error.apps.internal unless the route
+// is in the table.
+type fakeDiscoverer map[string][]Host
+
+func (fd fakeDiscoverer) Discover(_ context.Context, domainName string) ([]Host, error) {
+	domainName = dns.CanonicalName(domainName)
+	if hosts, ok := fd[domainName]; ok {
+		return hosts, nil
+	}
+	if domainName == "error.apps.internal." {
+		return nil, errors.New("fake discoverer failure")
+	}
+	return nil, nil
+}
+
+func (fd fakeDiscoverer) List(_ context.Context) (map[string][]Host, error) {
+	routes := make(map[string][]Host, len(fd))
+	for name, hosts := range fd {
+		routes[name] = hosts
+	}
+	return routes, nil
+}
+
+var fakeRoutes = fakeDiscoverer{
+	"v4.apps.internal.": {
+		{IPAddress: "10.11.12.13", Tags: map[string]interface{}{"az": "z1"}},
+		{IPAddress: "10.11.12.14", Tags: map[string]interface{}{"az": "z2"}},
+	},
+	"v6.apps.internal.": {
+		{IPAddress: "2001:db8::68"},
+	},
+	"db.apps.internal.": {
+		{IPAddress: "10.11.12.20", Tags: map[string]interface{}{instanceIndexTag: "0"}},
+		{IPAddress: "10.11.12.21", Tags: map[string]interface{}{instanceIndexTag: "1"}},
+	},
+	"bogus.apps.internal.": {
+		{IPAddress: "127.0.0.1"},
+		{IPAddress: "not-an-ip"},
+		{IPAddress: "10.11.12.13"},
+	},
+}
+
+func newTestServiceDiscovery() *ServiceDiscovery {
+	return &ServiceDiscovery{
+		Next:        test.NextHandler(dns.RcodeNameError, nil),
+		log:         clog.NewWithPlugin(pluginName),
+		discoverer:  fakeRoutes,
+		ttl:         &ttlPolicy{ttl: 300},
+		addresses:   &addressFilter{},
+		synthesis:   &ipv6Synthesis{mode: ipv6SynthesisMapped},
+		instanceTag: instanceIndexTag,
+	}
+}
+
+func TestServeDNS(t *testing.T) {
+	tests := []struct {
+		name   string
+		modify func(sd *ServiceDiscovery)
+		tc     test.Case
+		err    bool
+	}{
+		{
+			name: "A",
+			tc: test.Case{
+				Qname: "v4.apps.internal.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("v4.apps.internal. 300 IN A 10.11.12.13"),
+					test.A("v4.apps.internal. 300 IN A 10.11.12.14"),
+				},
+			},
+		},
+		{
+			name: "unknown route falls through",
+			tc: test.Case{
+				Qname: "unknown.apps.internal.", Qtype: dns.TypeA,
+				Rcode: dns.RcodeNameError,
+			},
+		},
+		{
+			name: "discoverer error",
+			tc: test.Case{
+				Qname: "error.apps.internal.", Qtype: dns.TypeA,
+				Rcode: dns.RcodeServerFailure,
+			},
+			err: true,
+		},
+		{
+			name: "invalid addresses are rejected",
+			tc: test.Case{
+				Qname: "bogus.apps.internal.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("bogus.apps.internal. 300 IN A 10.11.12.13"),
+				},
+			},
+		},
+		{
+			name: "AAAA mapped",
+			tc: test.Case{
+				Qname: "v4.apps.internal.", Qtype: dns.TypeAAAA,
+				Answer: []dns.RR{
+					test.AAAA("v4.apps.internal. 300 IN AAAA ::ffff:10.11.12.13"),
+					test.AAAA("v4.apps.internal. 300 IN AAAA ::ffff:10.11.12.14"),
+				},
+			},
+		},
+		{
+			name: "AAAA dns64",
+			modify: func(sd *ServiceDiscovery) {
+				sd.synthesis, _ = parseIPv6Synthesis([]string{"dns64", "64:ff9b::/96"})
+			},
+			tc: test.Case{
+				Qname: "v4.apps.internal.", Qtype: dns.TypeAAAA,
+				Answer: []dns.RR{
+					test.AAAA("v4.apps.internal. 300 IN AAAA 64:ff9b::a0b:c0d"),
+					test.AAAA("v4.apps.internal. 300 IN AAAA 64:ff9b::a0b:c0e"),
+				},
+			},
+		},
+		{
+			name: "AAAA none with negative TTL",
+			modify: func(sd *ServiceDiscovery) {
+				sd.synthesis = &ipv6Synthesis{mode: ipv6SynthesisNone}
+				negative := uint32(5)
+				sd.ttl.negative = &negative
+				sd.ttl.zones = map[string]uint32{"apps.internal.": 300}
+				sd.ttl.sortZones()
+			},
+			tc: test.Case{
+				Qname: "v4.apps.internal.", Qtype: dns.TypeAAAA,
+				Ns: []dns.RR{
+					test.SOA("apps.internal. 5 IN SOA ns.dns.apps.internal. hostmaster.apps.internal. 1 7200 1800 86400 5"),
+				},
+			},
+		},
+		{
+			name: "AAAA none with negative TTL outside of a zone",
+			modify: func(sd *ServiceDiscovery) {
+				sd.synthesis = &ipv6Synthesis{mode: ipv6SynthesisNone}
+				negative := uint32(5)
+				sd.ttl.negative = &negative
+			},
+			tc: test.Case{
+				Qname: "v4.apps.internal.", Qtype: dns.TypeAAAA,
+			},
+		},
+		{
+			name: "alias",
+			modify: func(sd *ServiceDiscovery) {
+				sd.aliases = newAliases()
+				sd.aliases.static["old.apps.internal."] = "v4.apps.internal."
+			},
+			tc: test.Case{
+				Qname: "old.apps.internal.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.CNAME("old.apps.internal. 300 IN CNAME v4.apps.internal."),
+					test.A("v4.apps.internal. 300 IN A 10.11.12.13"),
+					test.A("v4.apps.internal. 300 IN A 10.11.12.14"),
+				},
+			},
+		},
+		{
+			name: "alias from tag",
+			modify: func(sd *ServiceDiscovery) {
+				sd.aliases = newAliases()
+				sd.aliases.tag = "alias_of"
+				sd.discoverer = fakeDiscoverer{
+					"old.apps.internal.": {{IPAddress: "10.11.12.13", Tags: map[string]interface{}{"alias_of": "v6.apps.internal"}}},
+					"v6.apps.internal.":  fakeRoutes["v6.apps.internal."],
+				}
+			},
+			tc: test.Case{
+				Qname: "old.apps.internal.", Qtype: dns.TypeAAAA,
+				Answer: []dns.RR{
+					test.CNAME("old.apps.internal. 300 IN CNAME v6.apps.internal."),
+					test.AAAA("v6.apps.internal. 300 IN AAAA 2001:db8::68"),
+				},
+			},
+		},
+		{
+			name: "alias loop",
+			modify: func(sd *ServiceDiscovery) {
+				sd.aliases = newAliases()
+				sd.aliases.static["a.apps.internal."] = "b.apps.internal."
+				sd.aliases.static["b.apps.internal."] = "a.apps.internal."
+			},
+			tc: test.Case{
+				Qname: "a.apps.internal.", Qtype: dns.TypeA,
+				Rcode: dns.RcodeServerFailure,
+			},
+			err: true,
+		},
+		{
+			name: "alias chain too long",
+			modify: func(sd *ServiceDiscovery) {
+				sd.aliases = newAliases()
+				sd.aliases.maxChain = 1
+				sd.aliases.static["a.apps.internal."] = "b.apps.internal."
+				sd.aliases.static["b.apps.internal."] = "v4.apps.internal."
+			},
+			tc: test.Case{
+				Qname: "a.apps.internal.", Qtype: dns.TypeA,
+				Rcode: dns.RcodeServerFailure,
+			},
+			err: true,
+		},
+		{
+			name: "instance index",
+			tc: test.Case{
+				Qname: "1.db.apps.internal.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("1.db.apps.internal. 300 IN A 10.11.12.21"),
+				},
+			},
+		},
+		{
+			name: "unknown instance index falls through",
+			tc: test.Case{
+				Qname: "2.db.apps.internal.", Qtype: dns.TypeA,
+				Rcode: dns.RcodeNameError,
+			},
+		},
+		{
+			name: "zero-padded instance index",
+			tc: test.Case{
+				Qname: "00.db.apps.internal.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("00.db.apps.internal. 300 IN A 10.11.12.20"),
+				},
+			},
+		},
+		{
+			name: "nested instance index falls through",
+			tc: test.Case{
+				Qname: "0.1.db.apps.internal.", Qtype: dns.TypeA,
+				Rcode: dns.RcodeNameError,
+			},
+		},
+		{
+			name: "instance index of an external name falls through",
+			modify: func(sd *ServiceDiscovery) {
+				sd.discoverer = fakeDiscoverer{"db.example.com.": fakeRoutes["db.apps.internal."]}
+			},
+			tc: test.Case{
+				Qname: "0.db.example.com.", Qtype: dns.TypeA,
+				Rcode: dns.RcodeNameError,
+			},
+		},
+		{
+			name: "instance index outside of the owned zones falls through",
+			modify: func(sd *ServiceDiscovery) {
+				sd.zones = newZoneAuthority([]string{"other.internal."})
+			},
+			tc: test.Case{
+				Qname: "0.db.apps.internal.", Qtype: dns.TypeA,
+				Rcode: dns.RcodeNameError,
+			},
+		},
+		{
+			name: "wildcard",
+			modify: func(sd *ServiceDiscovery) {
+				sd.wildcards = wildcards{"team.apps.internal.": "db.apps.internal."}
+			},
+			tc: test.Case{
+				Qname: "peer.team.apps.internal.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("peer.team.apps.internal. 300 IN A 10.11.12.20"),
+					test.A("peer.team.apps.internal. 300 IN A 10.11.12.21"),
+				},
+			},
+		},
+		{
+			name: "wildcard instance index",
+			modify: func(sd *ServiceDiscovery) {
+				sd.wildcards = wildcards{"team.apps.internal.": "db.apps.internal."}
+			},
+			tc: test.Case{
+				Qname: "0.peer.team.apps.internal.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("0.peer.team.apps.internal. 300 IN A 10.11.12.20"),
+				},
+			},
+		},
+		{
+			name: "locality",
+			modify: func(sd *ServiceDiscovery) {
+				_, subnet, _ := net.ParseCIDR("10.240.0.0/16")
+				sd.locality = newLocality()
+				sd.locality.zones = []localityZone{{subnet: subnet, name: "z2"}}
+			},
+			tc: test.Case{
+				Qname: "v4.apps.internal.", Qtype: dns.TypeA,
+				Answer: []dns.RR{
+					test.A("v4.apps.internal. 300 IN A 10.11.12.14"),
+				},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sd := newTestServiceDiscovery()
+			if tt.modify != nil {
+				tt.modify(sd)
+			}
+
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			rcode, err := sd.ServeDNS(context.Background(), rec, tt.tc.Msg())
+			if tt.err != (err != nil) {
+				t.Fatalf("expected error %t, got %v", tt.err, err)
+			}
+			if rec.Msg == nil {
+				if rcode != tt.tc.Rcode {
+					t.Errorf("expected rcode %d, got %d", tt.tc.Rcode, rcode)
+				}
+				return
+			}
+			if err := test.SortAndCheck(rec.Msg, tt.tc); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
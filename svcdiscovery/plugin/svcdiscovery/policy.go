@@ -0,0 +1,260 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+)
+
+const (
+	policyServerEndpoint = "/networking/v1/internal/policies"
+
+	defaultPolicyCacheTTL = 30 * time.Second
+	defaultPolicyRefresh  = 30 * time.Second
+)
+
+// policyFilter restricts the answers to the hosts the client is allowed to
+// reach by the Cloud Foundry network policies. The client is identified by
+// mapping its address to the app GUID of a registered host, and the policies
+// of its app are fetched from the internal API of the policy server.
+type policyFilter struct {
+	discoverer Discoverer
+	httpClient *http.Client
+	// policiesURL is the URL of the internal policies endpoint.
+	policiesURL string
+	cacheTTL    time.Duration
+	refresh     time.Duration
+	// denyUnknown denies all the routes to the clients that are not app
+	// instances, which are otherwise not filtered.
+	denyUnknown bool
+	log         clog.P
+
+	mu sync.RWMutex
+	// apps maps the addresses of the registered hosts to their app GUID.
+	apps map[string]string
+	// cache holds the destinations allowed for each source app GUID.
+	cache map[string]policyCacheEntry
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// policyCacheEntry are the destinations allowed for a source app, mapping the
+// destination app GUIDs to the allowed port ranges.
+type policyCacheEntry struct {
+	destinations map[string][]policyPorts
+	expires      time.Time
+}
+
+// policyServerResponse represents a response from the internal policies
+// endpoint of the policy server. An example response in JSON:
+//
+// {
+//   "total_policies": 1,
+//   "policies": [
+//     {
+//       "source": {"id": "source-app-guid", "tag": "0001"},
+//       "destination": {
+//         "id": "destination-app-guid",
+//         "tag": "0002",
+//         "protocol": "tcp",
+//         "ports": {"start": 8080, "end": 8080}
+//       }
+//     }
+//   ]
+// }
+type policyServerResponse struct {
+	Policies []struct {
+		Source struct {
+			ID string `json:"id"`
+		} `json:"source"`
+		Destination struct {
+			ID    string      `json:"id"`
+			Ports policyPorts `json:"ports"`
+		} `json:"destination"`
+	} `json:"policies"`
+}
+
+// policyPorts is the range of destination ports allowed by a policy.
+type policyPorts struct {
+	Start uint16 `json:"start"`
+	End   uint16 `json:"end"`
+}
+
+func newPolicyFilter(discoverer Discoverer, httpClient *http.Client, policyServerURL string) *policyFilter {
+	return &policyFilter{
+		discoverer:  discoverer,
+		httpClient:  httpClient,
+		policiesURL: policyServerURL + policyServerEndpoint,
+		cacheTTL:    defaultPolicyCacheTTL,
+		refresh:     defaultPolicyRefresh,
+		log:         clog.NewWithPlugin(pluginName),
+		apps:        make(map[string]string),
+		cache:       make(map[string]policyCacheEntry),
+		stopCh:      make(chan struct{}),
+		doneCh:      make(chan struct{}),
+	}
+}
+
+// Start maps the addresses of the registered hosts to their app and starts
+// refreshing the mapping periodically.
+func (pf *policyFilter) Start() error {
+	if err := pf.refreshApps(); err != nil {
+		pf.log.Warning(err)
+	}
+
+	go func() {
+		defer close(pf.doneCh)
+		ticker := time.NewTicker(pf.refresh)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-pf.stopCh:
+				return
+			case <-ticker.C:
+				if err := pf.refreshApps(); err != nil {
+					pf.log.Warning(err)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops refreshing the mapping of the addresses to their app.
+func (pf *policyFilter) Stop() error {
+	close(pf.stopCh)
+	<-pf.doneCh
+	return nil
+}
+
+// refreshApps maps the addresses of the hosts of all the routes to the app
+// GUID they are tagged with, and evicts the expired policies from the cache.
+func (pf *policyFilter) refreshApps() error {
+	ctx, cancel := context.WithTimeout(context.Background(), pf.refresh)
+	defer cancel()
+	routes, err := listRoutes(ctx, pf.discoverer)
+	if err != nil {
+		return fmt.Errorf("failed to map the client addresses to apps: %w", err)
+	}
+	apps := make(map[string]string)
+	for _, hosts := range routes {
+		for _, host := range hosts {
+			if guid, ok := host.Tag(appGUIDTag); ok {
+				apps[host.IPAddress] = guid
+			}
+		}
+	}
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	pf.apps = apps
+	now := time.Now()
+	for source, entry := range pf.cache {
+		if !now.Before(entry.expires) {
+			delete(pf.cache, source)
+		}
+	}
+	return nil
+}
+
+// filter returns the hosts the client is allowed to reach. Hosts without an
+// app GUID are never allowed to app clients.
+func (pf *policyFilter) filter(ctx context.Context, clientIP string, hosts []Host, now time.Time) ([]Host, error) {
+	pf.mu.RLock()
+	source, ok := pf.apps[clientIP]
+	pf.mu.RUnlock()
+	if !ok {
+		if pf.denyUnknown {
+			return nil, nil
+		}
+		return hosts, nil
+	}
+
+	destinations, err := pf.destinations(ctx, source, now)
+	if err != nil {
+		return nil, err
+	}
+	allowed := make([]Host, 0, len(hosts))
+	for _, host := range hosts {
+		guid, ok := host.Tag(appGUIDTag)
+		if !ok {
+			continue
+		}
+		ranges, ok := destinations[guid]
+		if !ok {
+			continue
+		}
+		for _, ports := range ranges {
+			if host.Port == 0 || (host.Port >= ports.Start && host.Port <= ports.End) {
+				allowed = append(allowed, host)
+				break
+			}
+		}
+	}
+	return allowed, nil
+}
+
+// destinations returns the destinations allowed for the source app, from the
+// cache when it's fresh.
+func (pf *policyFilter) destinations(ctx context.Context, source string, now time.Time) (map[string][]policyPorts, error) {
+	pf.mu.RLock()
+	entry, ok := pf.cache[source]
+	pf.mu.RUnlock()
+	if ok && now.Before(entry.expires) {
+		return entry.destinations, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pf.policiesURL+"?id="+url.QueryEscape(source), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch network policies: %w", err)
+	}
+	res, err := pf.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch network policies: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch network policies: unexpected status %s", res.Status)
+	}
+	var policyResponse policyServerResponse
+	if err := json.NewDecoder(res.Body).Decode(&policyResponse); err != nil {
+		return nil, fmt.Errorf("failed to fetch network policies: %w", err)
+	}
+
+	destinations := make(map[string][]policyPorts)
+	for _, policy := range policyResponse.Policies {
+		// The policies where the app is the destination are returned too.
+		if policy.Source.ID != source {
+			continue
+		}
+		destinations[policy.Destination.ID] = append(destinations[policy.Destination.ID], policy.Destination.Ports)
+	}
+
+	pf.mu.Lock()
+	defer pf.mu.Unlock()
+	pf.cache[source] = policyCacheEntry{destinations: destinations, expires: now.Add(pf.cacheTTL)}
+	return destinations, nil
+}
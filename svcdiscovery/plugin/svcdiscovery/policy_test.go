@@ -0,0 +1,152 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPolicyFilter(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != policyServerEndpoint || r.URL.Query().Get("id") != "frontend-guid" {
+			t.Errorf("unexpected request: %s", r.URL)
+		}
+		w.Write([]byte(`{
+			"total_policies": 2,
+			"policies": [
+				{
+					"source": {"id": "frontend-guid"},
+					"destination": {"id": "backend-guid", "protocol": "tcp", "ports": {"start": 8080, "end": 8080}}
+				},
+				{
+					"source": {"id": "other-guid"},
+					"destination": {"id": "frontend-guid", "protocol": "tcp", "ports": {"start": 8080, "end": 8080}}
+				}
+			]
+		}`))
+	}))
+	defer server.Close()
+
+	frontend := Host{IPAddress: "10.11.12.13", Port: 8080, Tags: map[string]interface{}{appGUIDTag: "frontend-guid"}}
+	backend := Host{IPAddress: "10.11.12.14", Port: 8080, Tags: map[string]interface{}{appGUIDTag: "backend-guid"}}
+	backendAdmin := Host{IPAddress: "10.11.12.14", Port: 9090, Tags: map[string]interface{}{appGUIDTag: "backend-guid"}}
+	untagged := Host{IPAddress: "10.11.12.15", Port: 8080}
+	discoverer := fakeDiscoverer{
+		"frontend.apps.internal.": {frontend},
+		"backend.apps.internal.":  {backend, backendAdmin},
+	}
+
+	pf := newPolicyFilter(discoverer, server.Client(), server.URL)
+	if err := pf.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Stop()
+
+	now := time.Now()
+	hosts := []Host{frontend, backend, backendAdmin, untagged}
+	allowed, err := pf.filter(context.Background(), "10.11.12.13", hosts, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(allowed) != 1 || allowed[0].key() != backend.key() {
+		t.Errorf("expected only the backend on port 8080, got %+v", allowed)
+	}
+
+	// The policies are cached.
+	if _, err := pf.filter(context.Background(), "10.11.12.13", hosts, now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 1 {
+		t.Errorf("expected the policies to be fetched once, got %d requests", requests)
+	}
+	if _, err := pf.filter(context.Background(), "10.11.12.13", hosts, now.Add(defaultPolicyCacheTTL)); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 {
+		t.Errorf("expected the expired policies to be fetched again, got %d requests", requests)
+	}
+
+	// Clients that are not app instances are not filtered, unless denied.
+	if allowed, _ := pf.filter(context.Background(), "10.0.0.1", hosts, now); len(allowed) != len(hosts) {
+		t.Errorf("expected all the hosts for an unknown client, got %+v", allowed)
+	}
+	pf.denyUnknown = true
+	if allowed, _ := pf.filter(context.Background(), "10.0.0.1", hosts, now); len(allowed) != 0 {
+		t.Errorf("expected no hosts for an unknown client, got %+v", allowed)
+	}
+}
+
+// TestPolicyFilterSDC shows why policy_server is rejected with the sdc backend
+// alone: the SDC responses carry no app GUIDs, so every client is unknown.
+func TestPolicyFilterSDC(t *testing.T) {
+	sdc := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/routes":
+			w.Write([]byte(`{"addresses": [{"hostname": "frontend.apps.internal", "ips": ["10.11.12.13"]}]}`))
+		case "/v1/registration/frontend.apps.internal.":
+			w.Write([]byte(`{"env": "", "hosts": [{"ip_address": "10.11.12.13", "last_check_in": "", "port": 0, "revision": "", "service": "", "service_repo_name": "", "tags": {}}], "service": ""}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer sdc.Close()
+	sdcc := &SDCClient{
+		httpClient:   sdc.Client(),
+		sdcURLBase:   sdc.URL + "/v1/registration/",
+		sdcRoutesURL: sdc.URL + "/routes",
+	}
+
+	hosts, err := sdcc.Discover(context.Background(), "frontend.apps.internal.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 {
+		t.Fatalf("expected a host, got %+v", hosts)
+	}
+	if _, ok := hosts[0].Tag(appGUIDTag); ok {
+		t.Errorf("expected no app GUID, got %+v", hosts[0])
+	}
+
+	pf := newPolicyFilter(sdcc, http.DefaultClient, "http://policy-server.invalid")
+	if err := pf.refreshApps(); err != nil {
+		t.Fatal(err)
+	}
+	if len(pf.apps) != 0 {
+		t.Errorf("expected no client apps, got %v", pf.apps)
+	}
+
+	tests := []struct {
+		backends []string
+		supplies bool
+	}{
+		{[]string{"sdc"}, false},
+		{[]string{"sdc", "kubernetes"}, true},
+		{[]string{"nats"}, true},
+		{[]string{"file"}, true},
+	}
+	for _, tt := range tests {
+		if supplies := suppliesAppGUIDs(tt.backends); supplies != tt.supplies {
+			t.Errorf("%v: expected %t, got %t", tt.backends, tt.supplies, supplies)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// rateLimitWindow is the interval for evicting the idle buckets and
+	// reporting the top offending clients.
+	rateLimitWindow         = time.Minute
+	rateLimitTopClientCount = 10
+)
+
+// rateLimitAction is what is answered to the requests exceeding the limit.
+type rateLimitAction int
+
+const (
+	// rateLimitRefuse answers REFUSED.
+	rateLimitRefuse rateLimitAction = iota
+	// rateLimitTruncate answers an empty truncated response, so legitimate
+	// clients retry over TCP. Requests over TCP are refused.
+	rateLimitTruncate
+)
+
+func parseRateLimitAction(s string) (rateLimitAction, error) {
+	switch s {
+	case "refuse":
+		return rateLimitRefuse, nil
+	case "truncate":
+		return rateLimitTruncate, nil
+	default:
+		return 0, fmt.Errorf("invalid rate limit action: %s", s)
+	}
+}
+
+func (a rateLimitAction) String() string {
+	if a == rateLimitTruncate {
+		return "truncate"
+	}
+	return "refuse"
+}
+
+// rateLimiter is a token bucket rate limiter of the requests of each client,
+// or of each client and route.
+type rateLimiter struct {
+	// rate is the number of requests per second refilling the buckets.
+	rate float64
+	// burst is the capacity of the buckets.
+	burst    float64
+	perRoute bool
+	action   rateLimitAction
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	// offenders counts the limited requests of each client in the current
+	// window.
+	offenders   map[string]uint64
+	windowStart time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate, burst float64) *rateLimiter {
+	return &rateLimiter{
+		rate:      rate,
+		burst:     burst,
+		buckets:   make(map[string]*tokenBucket),
+		offenders: make(map[string]uint64),
+	}
+}
+
+// allow takes a token from the bucket of the client, or of the client and
+// route, and returns whether there was one.
+func (rl *rateLimiter) allow(client, qname string, now time.Time) bool {
+	key := client
+	if rl.perRoute {
+		key += " " + qname
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if now.Sub(rl.windowStart) >= rateLimitWindow {
+		rl.endWindow(now)
+	}
+
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * rl.rate
+	if bucket.tokens > rl.burst {
+		bucket.tokens = rl.burst
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		rl.offenders[client]++
+		RateLimitedCount.WithLabelValues(rl.action.String()).Inc()
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+// endWindow evicts the buckets that would be full by now and reports the top
+// offending clients of the window. It must be called with the lock held.
+func (rl *rateLimiter) endWindow(now time.Time) {
+	for key, bucket := range rl.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*rl.rate >= rl.burst {
+			delete(rl.buckets, key)
+		}
+	}
+
+	clients := make([]string, 0, len(rl.offenders))
+	for client := range rl.offenders {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return rl.offenders[clients[i]] > rl.offenders[clients[j]]
+	})
+	if len(clients) > rateLimitTopClientCount {
+		clients = clients[:rateLimitTopClientCount]
+	}
+	RateLimitedTopClients.Reset()
+	for _, client := range clients {
+		RateLimitedTopClients.WithLabelValues(client).Set(float64(rl.offenders[client]))
+	}
+
+	rl.offenders = make(map[string]uint64)
+	rl.windowStart = now
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(1, 2)
+	now := time.Now()
+
+	for i := 0; i < 2; i++ {
+		if !rl.allow("10.0.0.1", "a.apps.internal.", now) {
+			t.Fatalf("expected request %d within the burst to be allowed", i)
+		}
+	}
+	if rl.allow("10.0.0.1", "b.apps.internal.", now) {
+		t.Error("expected the request exceeding the burst to be limited")
+	}
+	if !rl.allow("10.0.0.2", "a.apps.internal.", now) {
+		t.Error("expected another client to be allowed")
+	}
+	if !rl.allow("10.0.0.1", "a.apps.internal.", now.Add(time.Second)) {
+		t.Error("expected the bucket to be refilled")
+	}
+
+	// The top offending clients are reported at the end of the window, and
+	// the idle buckets are evicted.
+	rl.allow("10.0.0.1", "a.apps.internal.", now.Add(rateLimitWindow+time.Second))
+	if v := testutil.ToFloat64(RateLimitedTopClients.WithLabelValues("10.0.0.1")); v != 1 {
+		t.Errorf("expected 1 limited request for the top client, got %v", v)
+	}
+	if len(rl.buckets) != 1 {
+		t.Errorf("expected the idle buckets to be evicted, got %d buckets", len(rl.buckets))
+	}
+
+	rl = newRateLimiter(1, 1)
+	rl.perRoute = true
+	rl.allow("10.0.0.1", "a.apps.internal.", now)
+	if !rl.allow("10.0.0.1", "b.apps.internal.", now) {
+		t.Error("expected another route to be allowed")
+	}
+}
+
+func TestServeDNSRateLimited(t *testing.T) {
+	sd := newTestServiceDiscovery()
+	sd.rateLimit = newRateLimiter(1, 1)
+	sd.rateLimit.action = rateLimitTruncate
+
+	req := new(dns.Msg)
+	req.SetQuestion("v4.apps.internal.", dns.TypeA)
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	sd.ServeDNS(context.Background(), rec, req)
+	if rec.Msg == nil || len(rec.Msg.Answer) == 0 {
+		t.Fatalf("expected an answer, got %v", rec.Msg)
+	}
+
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	sd.ServeDNS(context.Background(), rec, req)
+	if rec.Msg == nil || !rec.Msg.Truncated || len(rec.Msg.Answer) != 0 {
+		t.Fatalf("expected a truncated answer, got %v", rec.Msg)
+	}
+
+	rec = dnstest.NewRecorder(&test.ResponseWriter{TCP: true})
+	if code, _ := sd.ServeDNS(context.Background(), rec, req); code != dns.RcodeRefused {
+		t.Errorf("expected REFUSED over TCP, got rcode %d", code)
+	}
+}
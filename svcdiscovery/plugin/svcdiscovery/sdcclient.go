@@ -21,38 +21,161 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	otlog "github.com/opentracing/opentracing-go/log"
+)
+
+// Tags of the SDC request spans.
+const (
+	sdcRouteTag = "sdc.route"
+	sdcHostsTag = "sdc.hosts"
 )
 
 // SDCClient is the Service Discovery Controller Client used to make calls to
 // the service-discovery-controller job to discover internal routes to apps.
 type SDCClient struct {
-	httpClient *http.Client
-	sdcURLBase string
+	httpClient   *http.Client
+	sdcURLBase   string
+	sdcRoutesURL string
+
+	mu sync.Mutex
+	// lastContact is the time of the last successful request.
+	lastContact   time.Time
+	lastError     error
+	lastErrorTime time.Time
+}
+
+// sdcStatus describes the reachability of the Service Discovery Controller.
+type sdcStatus struct {
+	URL string `json:"url"`
+	// Reachable is true when the last request was successful.
+	Reachable     bool       `json:"reachable"`
+	LastContact   *time.Time `json:"last_contact,omitempty"`
+	LastError     string     `json:"last_error,omitempty"`
+	LastErrorTime *time.Time `json:"last_error_time,omitempty"`
 }
 
 // Discover discovers internal app routes from the Service Discovery Controller
-// and returns the list of IPs from these discovered routes.
-func (sdcc *SDCClient) Discover(ctx context.Context, domainName string) ([]string, error) {
+// and returns the list of hosts from these discovered routes. It satisfies
+// Discoverer.Discover. When the request is traced, the SDC request is a child
+// span of the request span, and its trace context is propagated to the SDC.
+func (sdcc *SDCClient) Discover(ctx context.Context, domainName string) (hosts []Host, err error) {
+	defer func() { sdcc.record(err) }()
 	url := sdcc.sdcURLBase + domainName
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to discover service: %w", err)
 	}
+
+	var child ot.Span
+	if span := ot.SpanFromContext(ctx); span != nil {
+		child = span.Tracer().StartSpan("sdc", ot.ChildOf(span.Context()))
+		child.SetTag(sdcRouteTag, domainName)
+		ext.HTTPMethod.Set(child, http.MethodGet)
+		ext.HTTPUrl.Set(child, url)
+		defer func() {
+			child.SetTag(sdcHostsTag, len(hosts))
+			if err != nil {
+				ext.Error.Set(child, true)
+				child.LogFields(otlog.Error(err))
+			}
+			child.Finish()
+		}()
+		if err := child.Tracer().Inject(child.Context(), ot.HTTPHeaders, ot.HTTPHeadersCarrier(req.Header)); err != nil {
+			child.LogFields(otlog.Error(err))
+		}
+	}
+
+	start := time.Now()
 	res, err := sdcc.httpClient.Do(req)
 	if err != nil {
+		lookupInfoFrom(ctx).addSDCRequest(url, 0, time.Since(start))
 		return nil, fmt.Errorf("failed to discover service: %w", err)
 	}
 	defer res.Body.Close()
+	lookupInfoFrom(ctx).addSDCRequest(url, res.StatusCode, time.Since(start))
+	if child != nil {
+		ext.HTTPStatusCode.Set(child, uint16(res.StatusCode))
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to discover service: unexpected status %s", res.Status)
+	}
 	decoder := json.NewDecoder(res.Body)
 	var sdcClientResponse SDCClientResponse
 	if err := decoder.Decode(&sdcClientResponse); err != nil {
 		return nil, fmt.Errorf("failed to discover service: %w", err)
 	}
-	ips := make([]string, len(sdcClientResponse.Hosts))
-	for i, host := range sdcClientResponse.Hosts {
-		ips[i] = host.IPAddress
+	return sdcClientResponse.Hosts, nil
+}
+
+// List lists all the internal app routes registered in the Service Discovery
+// Controller. The hosts only carry their IP addresses. It satisfies
+// Lister.List.
+func (sdcc *SDCClient) List(ctx context.Context) (routes map[string][]Host, err error) {
+	defer func() { sdcc.record(err) }()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sdcc.sdcRoutesURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %w", err)
+	}
+	res, err := sdcc.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %w", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list routes: unexpected status %s", res.Status)
+	}
+	decoder := json.NewDecoder(res.Body)
+	var sdcRoutesResponse SDCRoutesResponse
+	if err := decoder.Decode(&sdcRoutesResponse); err != nil {
+		return nil, fmt.Errorf("failed to list routes: %w", err)
+	}
+	routes = make(map[string][]Host, len(sdcRoutesResponse.Addresses))
+	for _, address := range sdcRoutesResponse.Addresses {
+		name := dns.Fqdn(strings.ToLower(address.Hostname))
+		for _, ip := range address.IPs {
+			routes[name] = append(routes[name], Host{IPAddress: ip})
+		}
+	}
+	return routes, nil
+}
+
+// record records the outcome of a request.
+func (sdcc *SDCClient) record(err error) {
+	sdcc.mu.Lock()
+	defer sdcc.mu.Unlock()
+	if err != nil {
+		sdcc.lastError = err
+		sdcc.lastErrorTime = time.Now()
+		return
 	}
-	return ips, nil
+	sdcc.lastContact = time.Now()
+}
+
+// status returns the reachability of the Service Discovery Controller.
+func (sdcc *SDCClient) status() sdcStatus {
+	sdcc.mu.Lock()
+	defer sdcc.mu.Unlock()
+	status := sdcStatus{
+		URL:       sdcc.sdcURLBase,
+		Reachable: !sdcc.lastContact.IsZero() && sdcc.lastContact.After(sdcc.lastErrorTime),
+	}
+	if !sdcc.lastContact.IsZero() {
+		lastContact := sdcc.lastContact
+		status.LastContact = &lastContact
+	}
+	if sdcc.lastError != nil {
+		lastErrorTime := sdcc.lastErrorTime
+		status.LastError = sdcc.lastError.Error()
+		status.LastErrorTime = &lastErrorTime
+	}
+	return status
 }
 
 // SDCClientResponse represents a response from the Service Discovery
@@ -74,11 +197,28 @@ func (sdcc *SDCClient) Discover(ctx context.Context, domainName string) ([]strin
 //   "service": ""
 // }
 //
-// It's important to notice that we only need the `ip_address` of each host in
-// the response to be able to construct the DNS answer, hence the reason why we
-// ignore the other JSON fields.
+// It's important to notice that we only decode the fields of each host in the
+// response that are part of a Host, hence the reason why we ignore the other
+// JSON fields.
 type SDCClientResponse struct {
-	Hosts []struct {
-		IPAddress string `json:"ip_address"`
-	} `json:"hosts"`
+	Hosts []Host `json:"hosts"`
+}
+
+// SDCRoutesResponse represents the response from the Service Discovery
+// Controller routes endpoint, listing all the registered routes. An example
+// response in JSON:
+//
+// {
+//   "addresses": [
+//     {
+//       "hostname": "myapp.apps.internal",
+//       "ips": ["10.255.141.235"]
+//     }
+//   ]
+// }
+type SDCRoutesResponse struct {
+	Addresses []struct {
+		Hostname string   `json:"hostname"`
+		IPs      []string `json:"ips"`
+	} `json:"addresses"`
 }
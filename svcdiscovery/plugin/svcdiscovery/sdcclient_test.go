@@ -0,0 +1,104 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	ot "github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestSDCClientDiscoverSpan(t *testing.T) {
+	var traceID string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		traceID = r.Header.Get("Mockpfx-Ids-Traceid")
+		fmt.Fprint(w, `{"hosts": [{"ip_address": "10.11.12.13"}, {"ip_address": "10.11.12.14"}]}`)
+	}))
+	defer server.Close()
+
+	sdcc := &SDCClient{
+		httpClient: server.Client(),
+		sdcURLBase: server.URL + "/v1/registration/",
+	}
+	tracer := mocktracer.New()
+	span := tracer.StartSpan("servedns")
+	ctx := ot.ContextWithSpan(context.Background(), span)
+
+	if _, err := sdcc.Discover(ctx, "myapp.apps.internal."); err != nil {
+		t.Fatal(err)
+	}
+	span.Finish()
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans, got %d", len(spans))
+	}
+	child, parent := spans[0], spans[1]
+	if child.ParentID != parent.SpanContext.SpanID {
+		t.Errorf("expected the SDC span to be a child of the request span")
+	}
+	if traceID != fmt.Sprint(parent.SpanContext.TraceID) {
+		t.Errorf("expected the trace ID %d to be propagated, got %q", parent.SpanContext.TraceID, traceID)
+	}
+	tags := map[string]interface{}{
+		sdcRouteTag:        "myapp.apps.internal.",
+		sdcHostsTag:        2,
+		"http.url":         server.URL + "/v1/registration/myapp.apps.internal.",
+		"http.status_code": uint16(http.StatusOK),
+	}
+	for key, expected := range tags {
+		if tag := child.Tag(key); tag != expected {
+			t.Errorf("expected tag %s to be %v, got %v", key, expected, tag)
+		}
+	}
+}
+
+func TestSDCClientDiscoverSpanError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The body is valid, the status alone makes the request fail.
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `{"hosts": []}`)
+	}))
+	defer server.Close()
+
+	sdcc := &SDCClient{
+		httpClient: server.Client(),
+		sdcURLBase: server.URL + "/v1/registration/",
+	}
+	tracer := mocktracer.New()
+	ctx := ot.ContextWithSpan(context.Background(), tracer.StartSpan("servedns"))
+
+	if _, err := sdcc.Discover(ctx, "myapp.apps.internal."); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	if spans[0].Tag("error") != true || spans[0].Tag("http.status_code") != uint16(http.StatusServiceUnavailable) {
+		t.Errorf("unexpected tags: %v", spans[0].Tags())
+	}
+	if status := sdcc.status(); status.Reachable || status.LastContact != nil || status.LastError == "" {
+		t.Errorf("expected the request to be recorded as a failure, got %+v", status)
+	}
+}
@@ -21,113 +21,912 @@ import (
 	"crypto/x509"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/caddyserver/caddy"
 	"github.com/coredns/coredns/core/dnsserver"
 	"github.com/coredns/coredns/plugin"
+	"github.com/coredns/coredns/plugin/metrics"
 	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/nats-io/nats.go"
 )
 
 const pluginName = "svcdiscovery"
 const sdcEndpointBase = "/v1/registration/"
+const sdcRoutesEndpoint = "/routes"
 
 // Register the plugin.
 func init() {
-	plugin.Register(pluginName, func(c *caddy.Controller) error {
-		// Ignore svcdiscovery token.
-		c.Next()
-
-		var sdcClient *SDCClient
-		var tlsCAPath string
-		var tlsClientCertPath string
-		var tlsClientKeyPath string
-		var sdcHost string
-		var sdcPort uint16
-		var ttl uint32
-		for c.NextBlock() {
-			key := c.Val()
+	plugin.Register(pluginName, setup)
+}
+
+func setup(c *caddy.Controller) error {
+	// Ignore svcdiscovery token.
+	c.Next()
+	config := blockConfig(c.Dispenser)
+
+	backends := []string{"sdc"}
+	chainPolicy := chainPolicyFirst
+	var shadowBackend string
+	var snapshotPath string
+	snapshotInterval := defaultSnapshotInterval
+	shadowSampleRate := defaultShadowSampleRate
+	var tlsCAPath string
+	var tlsClientCertPath string
+	var tlsClientKeyPath string
+	var sdcHost string
+	var sdcPort uint16
+	var filePath string
+	fileReload := defaultFileReload
+	var natsURLs []string
+	var natsTLSCAPath string
+	var natsTLSClientCertPath string
+	var natsTLSClientKeyPath string
+	natsConfig := NATSDiscovererConfig{
+		Staleness:        defaultNATSStaleness,
+		PruneInterval:    defaultNATSPruneInterval,
+		RegisterInterval: defaultNATSRegisterInterval,
+	}
+	var k8sKubeconfigPath string
+	k8sConfig := K8sDiscovererConfig{
+		LabelSelector:    defaultK8sLabelSelector,
+		RoutesAnnotation: defaultK8sRoutesAnnotation,
+		SyncTimeout:      defaultK8sSyncTimeout,
+	}
+	ttl := newTTLPolicy()
+	var loc *locality
+	var stale *staleness
+	addresses := &addressFilter{}
+	synthesis := &ipv6Synthesis{mode: ipv6SynthesisMapped}
+	routeAliases := newAliases()
+	routeWildcards := make(wildcards)
+	instanceTag := instanceIndexTag
+	alpnTag := defaultALPNTag
+	authority := newZoneAuthority(nil)
+	var acl *accessControl
+	var policyServerURL string
+	var policyTLSCAPath string
+	var policyTLSClientCertPath string
+	var policyTLSClientKeyPath string
+	policyCacheTTL := defaultPolicyCacheTTL
+	policyRefresh := defaultPolicyRefresh
+	policyDenyUnknown := false
+	var rateLimit *rateLimiter
+	var audit *auditLog
+	var transferAllow []*net.IPNet
+	var admin *adminServer
+	var chaos *chaosResponder
+	for c.NextBlock() {
+		key := c.Val()
+		switch key {
+		case "backend":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			backends = args
+		case "chain_policy":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			policy, err := parseChainPolicy(args[0])
+			if err != nil {
+				return plugin.Error(pluginName, c.Err(err.Error()))
+			}
+			chainPolicy = policy
+		case "shadow_backend":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			shadowBackend = args[0]
+		case "shadow_sample_rate":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			f, err := strconv.ParseFloat(args[0], 64)
+			if err != nil || f < 0 || f > 1 {
+				return plugin.Error(pluginName, c.Errf("invalid shadow_sample_rate: %s", args[0]))
+			}
+			shadowSampleRate = f
+		case "snapshot_path":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			snapshotPath = args[0]
+		case "snapshot_interval":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			d, err := time.ParseDuration(args[0])
+			if err != nil || d <= 0 {
+				return plugin.Error(pluginName, c.Errf("invalid snapshot_interval: %s", args[0]))
+			}
+			snapshotInterval = d
+		case "tls_ca_path":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			tlsCAPath = args[0]
+		case "tls_client_cert_path":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			tlsClientCertPath = args[0]
+		case "tls_client_key_path":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			tlsClientKeyPath = args[0]
+		case "sdc_host":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			sdcHost = args[0]
+		case "sdc_port":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			u, err := strconv.ParseUint(args[0], 10, 16)
+			if err != nil {
+				return plugin.Error(pluginName, c.Errf("failed to convert sdc_port: %v", err))
+			}
+			sdcPort = uint16(u)
+		case "file_path":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			filePath = args[0]
+		case "file_reload":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			d, err := time.ParseDuration(args[0])
+			if err != nil || d <= 0 {
+				return plugin.Error(pluginName, c.Errf("invalid file_reload: %s", args[0]))
+			}
+			fileReload = d
+		case "nats_url":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			natsURLs = append(natsURLs, args...)
+		case "nats_tls_ca_path":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			natsTLSCAPath = args[0]
+		case "nats_tls_client_cert_path":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			natsTLSClientCertPath = args[0]
+		case "nats_tls_client_key_path":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			natsTLSClientKeyPath = args[0]
+		case "nats_staleness", "nats_prune_interval":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			d, err := time.ParseDuration(args[0])
+			if err != nil || d <= 0 {
+				return plugin.Error(pluginName, c.Errf("invalid %s: %s", key, args[0]))
+			}
+			if key == "nats_staleness" {
+				natsConfig.Staleness = d
+			} else {
+				natsConfig.PruneInterval = d
+			}
+		case "k8s_kubeconfig":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			k8sKubeconfigPath = args[0]
+		case "k8s_namespace":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			k8sConfig.Namespace = args[0]
+		case "k8s_label_selector":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			k8sConfig.LabelSelector = args[0]
+		case "k8s_routes_annotation":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			k8sConfig.RoutesAnnotation = args[0]
+		case "k8s_sync_timeout":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			d, err := time.ParseDuration(args[0])
+			if err != nil || d <= 0 {
+				return plugin.Error(pluginName, c.Errf("invalid k8s_sync_timeout: %s", args[0]))
+			}
+			k8sConfig.SyncTimeout = d
+		case "ttl":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			u, err := strconv.ParseUint(args[0], 10, 32)
+			if err != nil {
+				return plugin.Error(pluginName, c.Errf("failed to convert TTL: %v", err))
+			}
+			ttl.ttl = uint32(u)
+		case "ttl_zone":
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			u, err := strconv.ParseUint(args[1], 10, 32)
+			if err != nil {
+				return plugin.Error(pluginName, c.Errf("failed to convert ttl_zone TTL: %v", err))
+			}
+			ttl.zones[plugin.Name(args[0]).Normalize()] = uint32(u)
+		case "ttl_min", "ttl_max", "ttl_negative":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			u, err := strconv.ParseUint(args[0], 10, 32)
+			if err != nil {
+				return plugin.Error(pluginName, c.Errf("failed to convert %s: %v", key, err))
+			}
+			v := uint32(u)
 			switch key {
-			case "tls_ca_path":
-				args := c.RemainingArgs()
-				if len(args) != 1 {
-					return plugin.Error(pluginName, c.ArgErr())
-				}
-				tlsCAPath = args[0]
-			case "tls_client_cert_path":
-				args := c.RemainingArgs()
-				if len(args) != 1 {
-					return plugin.Error(pluginName, c.ArgErr())
+			case "ttl_min":
+				ttl.min = v
+			case "ttl_max":
+				ttl.max = v
+			case "ttl_negative":
+				ttl.negative = &v
+			}
+		case "ttl_tag":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			ttl.tag = args[0]
+		case "locality_tag":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			if loc == nil {
+				loc = newLocality()
+			}
+			loc.tag = args[0]
+		case "locality_zone":
+			args := c.RemainingArgs()
+			if len(args) < 2 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			if loc == nil {
+				loc = newLocality()
+			}
+			for _, cidr := range args[1:] {
+				_, subnet, err := net.ParseCIDR(cidr)
+				if err != nil {
+					return plugin.Error(pluginName, c.Errf("failed to parse locality_zone subnet: %v", err))
 				}
-				tlsClientCertPath = args[0]
-			case "tls_client_key_path":
-				args := c.RemainingArgs()
-				if len(args) != 1 {
-					return plugin.Error(pluginName, c.ArgErr())
+				loc.zones = append(loc.zones, localityZone{subnet: subnet, name: args[0]})
+			}
+		case "locality_mode":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			if loc == nil {
+				loc = newLocality()
+			}
+			mode, err := parseLocalityMode(args[0])
+			if err != nil {
+				return plugin.Error(pluginName, c.Err(err.Error()))
+			}
+			loc.mode = mode
+		case "locality_min_hosts":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			if loc == nil {
+				loc = newLocality()
+			}
+			u, err := strconv.ParseUint(args[0], 10, 16)
+			if err != nil || u == 0 {
+				return plugin.Error(pluginName, c.Errf("invalid locality_min_hosts: %s", args[0]))
+			}
+			loc.minHosts = int(u)
+		case "max_staleness":
+			args := c.RemainingArgs()
+			if len(args) < 1 || len(args) > 2 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			d, err := time.ParseDuration(args[0])
+			if err != nil || d <= 0 {
+				return plugin.Error(pluginName, c.Errf("invalid max_staleness: %s", args[0]))
+			}
+			stale = &staleness{maxAge: d}
+			if len(args) == 2 {
+				if args[1] != "drop_all" {
+					return plugin.Error(pluginName, c.Errf("invalid max_staleness option: %s", args[1]))
 				}
-				tlsClientKeyPath = args[0]
-			case "sdc_host":
-				args := c.RemainingArgs()
-				if len(args) != 1 {
-					return plugin.Error(pluginName, c.ArgErr())
+				stale.dropAll = true
+			}
+		case "answer_allow", "answer_deny":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			for _, cidr := range args {
+				_, subnet, err := net.ParseCIDR(cidr)
+				if err != nil {
+					return plugin.Error(pluginName, c.Errf("failed to parse %s subnet: %v", key, err))
 				}
-				sdcHost = args[0]
-			case "sdc_port":
-				args := c.RemainingArgs()
-				if len(args) != 1 {
-					return plugin.Error(pluginName, c.ArgErr())
+				if key == "answer_allow" {
+					addresses.allow = append(addresses.allow, subnet)
+				} else {
+					addresses.deny = append(addresses.deny, subnet)
 				}
-				u, err := strconv.ParseUint(args[0], 10, 16)
+			}
+		case "ipv6_synthesis":
+			var err error
+			synthesis, err = parseIPv6Synthesis(c.RemainingArgs())
+			if err != nil {
+				return plugin.Error(pluginName, c.Err(err.Error()))
+			}
+		case "alias":
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			from := plugin.Name(args[0]).Normalize()
+			if _, ok := routeAliases.static[from]; ok {
+				return plugin.Error(pluginName, c.Errf("duplicate alias: %s", args[0]))
+			}
+			routeAliases.static[from] = plugin.Name(args[1]).Normalize()
+		case "alias_tag":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			routeAliases.tag = args[0]
+		case "alias_max_chain":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			u, err := strconv.ParseUint(args[0], 10, 8)
+			if err != nil {
+				return plugin.Error(pluginName, c.Errf("failed to convert alias_max_chain: %v", err))
+			}
+			routeAliases.maxChain = int(u)
+		case "wildcard":
+			args := c.RemainingArgs()
+			if len(args) != 2 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			if !strings.HasPrefix(args[0], "*.") {
+				return plugin.Error(pluginName, c.Errf("invalid wildcard route: %s", args[0]))
+			}
+			routeWildcards[plugin.Name(args[0][2:]).Normalize()] = plugin.Name(args[1]).Normalize()
+		case "instance_index_tag":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			instanceTag = args[0]
+		case "alpn_tag":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			alpnTag = args[0]
+		case "acl":
+			// The rules are in a nested block, one per line.
+			if !c.NextArg() || c.Val() != "{" {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			acl = &accessControl{}
+			for c.Next() && c.Val() != "}" {
+				rule, err := parseACLRule(c.Val(), c.RemainingArgs())
 				if err != nil {
-					return plugin.Error(pluginName, c.Errf("failed to convert sdc_port: %w", err))
+					return plugin.Error(pluginName, c.Err(err.Error()))
 				}
-				sdcPort = uint16(u)
-			case "ttl":
-				args := c.RemainingArgs()
-				if len(args) != 1 {
-					return plugin.Error(pluginName, c.ArgErr())
+				acl.rules = append(acl.rules, rule)
+			}
+			if c.Val() != "}" {
+				return plugin.Error(pluginName, c.EOFErr())
+			}
+		case "admin_listen":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			if _, _, err := net.SplitHostPort(args[0]); err != nil {
+				return plugin.Error(pluginName, c.Errf("invalid admin_listen: %s", args[0]))
+			}
+			if admin == nil {
+				admin = newAdminServer()
+			}
+			admin.addr = args[0]
+		case "admin_token":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			if admin == nil {
+				admin = newAdminServer()
+			}
+			admin.token = args[0]
+		case "policy_server":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			u, err := url.Parse(args[0])
+			if err != nil || u.Host == "" {
+				return plugin.Error(pluginName, c.Errf("invalid policy_server: %s", args[0]))
+			}
+			policyServerURL = strings.TrimSuffix(args[0], "/")
+		case "policy_tls_ca_path", "policy_tls_client_cert_path", "policy_tls_client_key_path":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			switch key {
+			case "policy_tls_ca_path":
+				policyTLSCAPath = args[0]
+			case "policy_tls_client_cert_path":
+				policyTLSClientCertPath = args[0]
+			case "policy_tls_client_key_path":
+				policyTLSClientKeyPath = args[0]
+			}
+		case "policy_cache_ttl", "policy_refresh":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			d, err := time.ParseDuration(args[0])
+			if err != nil || d <= 0 {
+				return plugin.Error(pluginName, c.Errf("invalid %s: %s", key, args[0]))
+			}
+			if key == "policy_cache_ttl" {
+				policyCacheTTL = d
+			} else {
+				policyRefresh = d
+			}
+		case "policy_deny_unknown":
+			if len(c.RemainingArgs()) != 0 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			policyDenyUnknown = true
+		case "ratelimit":
+			args := c.RemainingArgs()
+			if len(args) != 1 && len(args) != 2 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			rate, err := strconv.ParseFloat(args[0], 64)
+			if err != nil || rate <= 0 {
+				return plugin.Error(pluginName, c.Errf("invalid ratelimit rate: %s", args[0]))
+			}
+			burst := math.Max(1, rate)
+			if len(args) == 2 {
+				u, err := strconv.ParseUint(args[1], 10, 32)
+				if err != nil || u == 0 {
+					return plugin.Error(pluginName, c.Errf("invalid ratelimit burst: %s", args[1]))
 				}
-				u, err := strconv.ParseUint(args[0], 10, 32)
+				burst = float64(u)
+			}
+			if rateLimit == nil {
+				rateLimit = newRateLimiter(0, 0)
+			}
+			rateLimit.rate = rate
+			rateLimit.burst = burst
+		case "ratelimit_per_route":
+			if len(c.RemainingArgs()) != 0 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			if rateLimit == nil {
+				rateLimit = newRateLimiter(0, 0)
+			}
+			rateLimit.perRoute = true
+		case "ratelimit_action":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			if rateLimit == nil {
+				rateLimit = newRateLimiter(0, 0)
+			}
+			action, err := parseRateLimitAction(args[0])
+			if err != nil {
+				return plugin.Error(pluginName, c.Err(err.Error()))
+			}
+			rateLimit.action = action
+		case "audit_log":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			if audit == nil {
+				audit = newAuditLog("")
+			}
+			audit.path = args[0]
+		case "audit_sample_rate":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			f, err := strconv.ParseFloat(args[0], 64)
+			if err != nil || f <= 0 || f > 1 {
+				return plugin.Error(pluginName, c.Errf("invalid audit_sample_rate: %s", args[0]))
+			}
+			if audit == nil {
+				audit = newAuditLog("")
+			}
+			audit.sampleRate = f
+		case "audit_max_size", "audit_max_backups":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			u, err := strconv.ParseUint(args[0], 10, 16)
+			if err != nil {
+				return plugin.Error(pluginName, c.Errf("failed to convert %s: %v", key, err))
+			}
+			if audit == nil {
+				audit = newAuditLog("")
+			}
+			if key == "audit_max_size" {
+				audit.maxSize = int64(u) * 1024 * 1024
+			} else {
+				audit.maxBackups = int(u)
+			}
+		case "zone":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			for _, zone := range args {
+				authority.zones = append(authority.zones, plugin.Name(zone).Normalize())
+			}
+		case "soa_mname", "soa_rname":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			if key == "soa_mname" {
+				authority.mname = plugin.Name(args[0]).Normalize()
+			} else {
+				authority.rname = parseMailbox(args[0])
+			}
+		case "soa_refresh", "soa_retry", "soa_expire":
+			args := c.RemainingArgs()
+			if len(args) != 1 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			u, err := strconv.ParseUint(args[0], 10, 32)
+			if err != nil {
+				return plugin.Error(pluginName, c.Errf("failed to convert %s: %v", key, err))
+			}
+			v := uint32(u)
+			switch key {
+			case "soa_refresh":
+				authority.refresh = v
+			case "soa_retry":
+				authority.retry = v
+			case "soa_expire":
+				authority.expire = v
+			}
+		case "transfer_allow":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			for _, cidr := range args {
+				_, subnet, err := net.ParseCIDR(cidr)
 				if err != nil {
-					return plugin.Error(pluginName, c.Errf("failed to convert TTL: %w", err))
+					return plugin.Error(pluginName, c.Errf("failed to parse transfer_allow subnet: %v", err))
 				}
-				ttl = uint32(u)
-			default:
-				return plugin.Error(pluginName, c.Errf("invalid configuration key: %s", key))
+				transferAllow = append(transferAllow, subnet)
+			}
+		case "chaos_allow":
+			args := c.RemainingArgs()
+			if len(args) == 0 {
+				return plugin.Error(pluginName, c.ArgErr())
+			}
+			if chaos == nil {
+				chaos = &chaosResponder{}
 			}
+			for _, cidr := range args {
+				_, subnet, err := net.ParseCIDR(cidr)
+				if err != nil {
+					return plugin.Error(pluginName, c.Errf("failed to parse chaos_allow subnet: %v", err))
+				}
+				chaos.allow = append(chaos.allow, subnet)
+			}
+		default:
+			return plugin.Error(pluginName, c.Errf("invalid configuration key: %s", key))
 		}
+	}
+
+	if ttl.max != 0 && ttl.min > ttl.max {
+		return plugin.Error(pluginName, c.Err("ttl_min must not be greater than ttl_max"))
+	}
+	ttl.sortZones()
+
+	if loc != nil && len(loc.zones) == 0 {
+		return plugin.Error(pluginName, c.Err("locality requires at least one locality_zone"))
+	}
+
+	if rateLimit != nil && rateLimit.rate == 0 {
+		return plugin.Error(pluginName, c.Err("ratelimit_per_route and ratelimit_action require ratelimit"))
+	}
+
+	if admin != nil && admin.addr == "" {
+		return plugin.Error(pluginName, c.Err("admin_token requires admin_listen"))
+	}
 
-		httpClient, err := newHTTPClient(tlsCAPath, tlsClientCertPath, tlsClientKeyPath)
+	if audit != nil {
+		if audit.path == "" {
+			return plugin.Error(pluginName, c.Err("the audit options require audit_log"))
+		}
+		c.OnStartup(audit.Start)
+		c.OnShutdown(audit.Stop)
+	}
+
+	if len(authority.zones) == 0 {
+		if len(transferAllow) > 0 {
+			return plugin.Error(pluginName, c.Err("transfer_allow requires at least one zone"))
+		}
+		authority = nil
+	}
+
+	var fileDiscoverer *FileDiscoverer
+	if filePath != "" {
+		var err error
+		fileDiscoverer, err = NewFileDiscoverer(filePath, fileReload)
 		if err != nil {
-			return plugin.Error(pluginName, c.Errf("failed to construct new HTTP client: %w", err))
+			return plugin.Error(pluginName, c.Err(err.Error()))
 		}
+		c.OnStartup(fileDiscoverer.Start)
+		c.OnShutdown(fileDiscoverer.Stop)
+	}
+
+	var sdcClients []*SDCClient
+	// newBackend creates the Discoverer for the backend name, registering its
+	// startup and shutdown hooks if needed.
+	newBackend := func(backend string) (Discoverer, error) {
+		switch backend {
+		case "sdc":
+			httpClient, err := newHTTPClient(tlsCAPath, tlsClientCertPath, tlsClientKeyPath)
+			if err != nil {
+				return nil, c.Errf("failed to construct new HTTP client: %v", err)
+			}
+
+			sdcURLBase := (&url.URL{
+				Scheme: "https",
+				Host:   fmt.Sprintf("%s:%d", sdcHost, sdcPort),
+				Path:   sdcEndpointBase,
+			}).String()
+
+			sdcRoutesURL := (&url.URL{
+				Scheme: "https",
+				Host:   fmt.Sprintf("%s:%d", sdcHost, sdcPort),
+				Path:   sdcRoutesEndpoint,
+			}).String()
 
-		sdcURLBase := (&url.URL{
-			Scheme: "https",
-			Host:   fmt.Sprintf("%s:%d", sdcHost, sdcPort),
-			Path:   sdcEndpointBase,
-		}).String()
+			sdcc := &SDCClient{
+				httpClient:   httpClient,
+				sdcURLBase:   sdcURLBase,
+				sdcRoutesURL: sdcRoutesURL,
+			}
+			sdcClients = append(sdcClients, sdcc)
+			return sdcc, nil
+		case "kubernetes":
+			client, err := newK8sClient(k8sKubeconfigPath)
+			if err != nil {
+				return nil, c.Errf("failed to construct new Kubernetes client: %v", err)
+			}
+			k8sDiscoverer, err := NewK8sDiscoverer(client, k8sConfig)
+			if err != nil {
+				return nil, c.Err(err.Error())
+			}
+			c.OnStartup(k8sDiscoverer.Start)
+			c.OnShutdown(k8sDiscoverer.Stop)
+			return k8sDiscoverer, nil
+		case "nats":
+			if len(natsURLs) == 0 {
+				return nil, c.Err("the nats backend requires nats_url")
+			}
+			var natsOptions []nats.Option
+			if natsTLSCAPath != "" {
+				natsOptions = append(natsOptions, nats.RootCAs(natsTLSCAPath))
+			}
+			if natsTLSClientCertPath != "" || natsTLSClientKeyPath != "" {
+				natsOptions = append(natsOptions, nats.ClientCert(natsTLSClientCertPath, natsTLSClientKeyPath))
+			}
+			natsDiscoverer := NewNATSDiscoverer(natsURLs, natsConfig, natsOptions...)
+			c.OnStartup(natsDiscoverer.Start)
+			c.OnShutdown(natsDiscoverer.Stop)
+			return natsDiscoverer, nil
+		case "file":
+			if fileDiscoverer == nil {
+				return nil, c.Err("the file backend requires file_path")
+			}
+			return fileDiscoverer, nil
+		default:
+			return nil, c.Errf("invalid backend: %s", backend)
+		}
+	}
 
-		sdcClient = &SDCClient{
-			httpClient: httpClient,
-			sdcURLBase: sdcURLBase,
+	// A backend shadowing itself would always agree.
+	for _, backend := range backends {
+		if backend == shadowBackend {
+			return plugin.Error(pluginName, c.Errf("shadow_backend is also a backend: %s", backend))
 		}
+	}
 
-		dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
-			return &ServiceDiscovery{
-				Next:      next,
-				log:       clog.NewWithPlugin(pluginName),
-				sdcClient: sdcClient,
-				ttl:       ttl,
+	discoverers := make([]Discoverer, 0, len(backends))
+	for i, backend := range backends {
+		for _, previous := range backends[:i] {
+			if backend == previous {
+				return plugin.Error(pluginName, c.Errf("duplicate backend: %s", backend))
 			}
+		}
+		d, err := newBackend(backend)
+		if err != nil {
+			return plugin.Error(pluginName, err)
+		}
+		discoverers = append(discoverers, d)
+	}
+
+	discoverer := discoverers[0]
+	if len(discoverers) > 1 {
+		discoverer = &chainDiscoverer{
+			names:       backends,
+			discoverers: discoverers,
+			policy:      chainPolicy,
+			log:         clog.NewWithPlugin(pluginName),
+		}
+	}
+
+	// The routes file is layered on top of the backends when it's not one of
+	// them, taking precedence over them.
+	if fileDiscoverer != nil && !usesFileBackend(backends) {
+		discoverer = &overrideDiscoverer{override: fileDiscoverer, base: discoverer}
+	}
+
+	var snapshot *snapshotDiscoverer
+	if snapshotPath != "" {
+		snapshot = newSnapshotDiscoverer(discoverer, snapshotPath, snapshotInterval)
+		c.OnStartup(snapshot.Start)
+		c.OnShutdown(snapshot.Stop)
+		discoverer = snapshot
+	}
+
+	if shadowBackend != "" {
+		// The shadow SDC client doesn't serve, so it isn't reported.
+		serving := sdcClients
+		shadow, err := newBackend(shadowBackend)
+		if err != nil {
+			return plugin.Error(pluginName, err)
+		}
+		sdcClients = serving
+		discoverer = newShadowDiscoverer(discoverer, shadow, shadowBackend, shadowSampleRate)
+	}
+
+	if chaos != nil {
+		chaos.sdc = sdcClients
+		chaos.snapshot = snapshot
+		// The server refuses the CHAOS questions unless a plugin answers them.
+		// The flag is global, so it's cleared on reload for the new
+		// configuration to set it again only when it still answers them.
+		dnsserver.EnableChaos[pluginName] = struct{}{}
+		c.OnRestart(func() error {
+			delete(dnsserver.EnableChaos, pluginName)
+			return nil
+		})
+		c.OnRestartFailed(func() error {
+			dnsserver.EnableChaos[pluginName] = struct{}{}
+			return nil
 		})
+	}
+
+	if admin != nil {
+		admin.snapshot = snapshot
+		admin.sdc = sdcClients
+		admin.config = config
+		// The listener is released before a reload starts the new one.
+		c.OnStartup(admin.Start)
+		c.OnRestart(admin.Stop)
+		c.OnRestartFailed(admin.Start)
+		c.OnFinalShutdown(admin.Stop)
+	}
 
+	var policy *policyFilter
+	if policyServerURL != "" {
+		// The SDC doesn't expose the app GUIDs of the hosts, without which
+		// every client would be unknown.
+		if !suppliesAppGUIDs(backends) && fileDiscoverer == nil {
+			return plugin.Error(pluginName, c.Err("policy_server requires the kubernetes, nats or file backend, or file_path, for the app GUIDs"))
+		}
+		httpClient, err := newHTTPClient(policyTLSCAPath, policyTLSClientCertPath, policyTLSClientKeyPath)
+		if err != nil {
+			return plugin.Error(pluginName, c.Err(err.Error()))
+		}
+		policy = newPolicyFilter(discoverer, httpClient, policyServerURL)
+		policy.cacheTTL = policyCacheTTL
+		policy.refresh = policyRefresh
+		policy.denyUnknown = policyDenyUnknown
+		c.OnStartup(policy.Start)
+		c.OnShutdown(policy.Stop)
+	}
+
+	c.OnStartup(func() error {
+		metrics.MustRegister(c, StaleHostsCount, RejectedAddressesCount, ShadowComparisonsCount,
+			RateLimitedCount, RateLimitedTopClients)
 		return nil
 	})
+
+	dnsserver.GetConfig(c).AddPlugin(func(next plugin.Handler) plugin.Handler {
+		return &ServiceDiscovery{
+			Next:          next,
+			log:           clog.NewWithPlugin(pluginName),
+			discoverer:    discoverer,
+			ttl:           ttl,
+			locality:      loc,
+			staleness:     stale,
+			addresses:     addresses,
+			synthesis:     synthesis,
+			aliases:       routeAliases,
+			wildcards:     routeWildcards,
+			instanceTag:   instanceTag,
+			alpnTag:       alpnTag,
+			acl:           acl,
+			policy:        policy,
+			rateLimit:     rateLimit,
+			audit:         audit,
+			zones:         authority,
+			transferAllow: transferAllow,
+			chaos:         chaos,
+		}
+	})
+
+	return nil
 }
 
 func newHTTPClient(tlsCAPath, tlsClientCertPath, tlsClientKeyPath string) (*http.Client, error) {
@@ -161,3 +960,23 @@ func newHTTPClient(tlsCAPath, tlsClientCertPath, tlsClientKeyPath string) (*http
 
 	return client, nil
 }
+
+// suppliesAppGUIDs returns whether any of the backends tags the hosts with
+// their app GUID, which the sdc backend doesn't.
+func suppliesAppGUIDs(backends []string) bool {
+	for _, backend := range backends {
+		if backend != "sdc" {
+			return true
+		}
+	}
+	return false
+}
+
+func usesFileBackend(backends []string) bool {
+	for _, backend := range backends {
+		if backend == "file" {
+			return true
+		}
+	}
+	return false
+}
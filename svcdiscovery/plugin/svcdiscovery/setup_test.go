@@ -0,0 +1,85 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy"
+	"github.com/coredns/coredns/core/dnsserver"
+)
+
+func TestSetupErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		input  string
+		errMsg string
+	}{
+		{"zero max_staleness", "svcdiscovery {\n max_staleness 0s\n}", "invalid max_staleness"},
+		{"negative max_staleness", "svcdiscovery {\n max_staleness -30s\n}", "invalid max_staleness"},
+		{"invalid max_staleness option", "svcdiscovery {\n max_staleness 30s drop\n}", "invalid max_staleness option"},
+		{"shadow of a backend", "svcdiscovery {\n backend sdc kubernetes\n shadow_backend sdc\n}", "shadow_backend is also a backend"},
+		{"shadow of the default backend", "svcdiscovery {\n shadow_backend sdc\n}", "shadow_backend is also a backend"},
+	}
+
+	for _, tt := range tests {
+		c := caddy.NewTestController("dns", tt.input)
+		err := setup(c)
+		if err == nil {
+			t.Errorf("%s: expected an error", tt.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.errMsg) {
+			t.Errorf("%s: expected an error containing %q, got %v", tt.name, tt.errMsg, err)
+		}
+	}
+}
+
+func TestSetupChaos(t *testing.T) {
+	defer delete(dnsserver.EnableChaos, pluginName)
+
+	dir, err := ioutil.TempDir("", "svcdiscovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "routes.yaml")
+	if err := ioutil.WriteFile(path, []byte("{}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config := "svcdiscovery {\n backend file\n file_path " + path + "\n"
+
+	c := caddy.NewTestController("dns", config+"}")
+	if err := setup(c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := dnsserver.EnableChaos[pluginName]; ok {
+		t.Error("expected the CHAOS class to be left disabled without chaos_allow")
+	}
+
+	c = caddy.NewTestController("dns", config+" chaos_allow 10.0.0.0/8\n}")
+	if err := setup(c); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, ok := dnsserver.EnableChaos[pluginName]; !ok {
+		t.Error("expected the CHAOS class to be enabled with chaos_allow")
+	}
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+)
+
+const (
+	defaultShadowSampleRate = 0.01
+	shadowTimeout           = 5 * time.Second
+	// shadowConcurrency bounds the shadow queries in flight. The comparisons
+	// are skipped when it's reached.
+	shadowConcurrency = 16
+)
+
+// shadowDiscoverer answers from the primary Discoverer while asynchronously
+// querying the shadow Discoverer for a sample of the routes and comparing both
+// answers. The shadow answers are never returned.
+type shadowDiscoverer struct {
+	primary Discoverer
+	shadow  Discoverer
+	name    string
+	// sampleRate is the fraction of lookups that are compared.
+	sampleRate float64
+	log        clog.P
+	// slots holds a token per shadow query in flight.
+	slots chan struct{}
+}
+
+func newShadowDiscoverer(primary, shadow Discoverer, name string, sampleRate float64) *shadowDiscoverer {
+	return &shadowDiscoverer{
+		primary:    primary,
+		shadow:     shadow,
+		name:       name,
+		sampleRate: sampleRate,
+		log:        clog.NewWithPlugin(pluginName),
+		slots:      make(chan struct{}, shadowConcurrency),
+	}
+}
+
+// Discover satisfies Discoverer.Discover.
+func (s *shadowDiscoverer) Discover(ctx context.Context, domainName string) ([]Host, error) {
+	hosts, err := s.primary.Discover(ctx, domainName)
+	if err != nil {
+		return nil, err
+	}
+
+	if rand.Float64() < s.sampleRate {
+		select {
+		case s.slots <- struct{}{}:
+			go func() {
+				defer func() { <-s.slots }()
+				s.compare(domainName, hosts)
+			}()
+		default:
+			ShadowComparisonsCount.WithLabelValues("skipped").Inc()
+		}
+	}
+
+	return hosts, nil
+}
+
+// List returns the routes of the primary Discoverer. It satisfies Lister.List.
+func (s *shadowDiscoverer) List(ctx context.Context) (map[string][]Host, error) {
+	return listRoutes(ctx, s.primary)
+}
+
+// compare queries the shadow Discoverer and records whether its answer matches
+// the primary hosts.
+func (s *shadowDiscoverer) compare(domainName string, primary []Host) {
+	// The request context is done as soon as the answer is written, so the
+	// shadow query gets its own.
+	ctx, cancel := context.WithTimeout(context.Background(), shadowTimeout)
+	defer cancel()
+
+	shadow, err := s.shadow.Discover(ctx, domainName)
+	if err != nil {
+		ShadowComparisonsCount.WithLabelValues("error").Inc()
+		s.log.Warningf("%s: shadow backend %s failed: %v", domainName, s.name, err)
+		return
+	}
+
+	// The SDC doesn't know the ports of the hosts, so they are only compared
+	// when both answers have them.
+	withPorts := hasPorts(primary) && hasPorts(shadow)
+	primaryKeys := hostKeys(primary, withPorts)
+	shadowKeys := hostKeys(shadow, withPorts)
+	if equalStrings(primaryKeys, shadowKeys) {
+		ShadowComparisonsCount.WithLabelValues("match").Inc()
+		return
+	}
+	ShadowComparisonsCount.WithLabelValues("mismatch").Inc()
+	s.log.Infof("%s: shadow backend %s mismatch: primary %v, shadow %v", domainName, s.name, primaryKeys, shadowKeys)
+}
+
+// hasPorts returns whether all the hosts have a port.
+func hasPorts(hosts []Host) bool {
+	for _, host := range hosts {
+		if host.Port == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// hostKeys returns the sorted and deduplicated IP, and port if withPorts, of
+// the hosts.
+func hostKeys(hosts []Host, withPorts bool) []string {
+	seen := make(map[string]struct{}, len(hosts))
+	keys := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		key := host.IPAddress
+		if withPorts {
+			key = host.key()
+		}
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
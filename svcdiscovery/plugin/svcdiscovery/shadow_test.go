@@ -0,0 +1,122 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// countingDiscoverer counts the lookups made to the wrapped Discoverer.
+type countingDiscoverer struct {
+	Discoverer
+	count int32
+}
+
+func (cd *countingDiscoverer) Discover(ctx context.Context, domainName string) ([]Host, error) {
+	atomic.AddInt32(&cd.count, 1)
+	return cd.Discoverer.Discover(ctx, domainName)
+}
+
+func TestShadowDiscovererCompare(t *testing.T) {
+	tests := []struct {
+		name    string
+		primary []Host
+		shadow  fakeDiscoverer
+		result  string
+	}{
+		{
+			name:    "same hosts",
+			primary: []Host{{IPAddress: "10.0.0.1", Port: 8080}, {IPAddress: "10.0.0.2", Port: 8080}},
+			shadow:  fakeDiscoverer{"myapp.apps.internal.": {{IPAddress: "10.0.0.2", Port: 8080}, {IPAddress: "10.0.0.1", Port: 8080}}},
+			result:  "match",
+		},
+		{
+			name:    "same IPs without ports",
+			primary: []Host{{IPAddress: "10.0.0.1"}, {IPAddress: "10.0.0.2"}},
+			shadow:  fakeDiscoverer{"myapp.apps.internal.": {{IPAddress: "10.0.0.1", Port: 8080}, {IPAddress: "10.0.0.2", Port: 8080}}},
+			result:  "match",
+		},
+		{
+			name:    "different ports",
+			primary: []Host{{IPAddress: "10.0.0.1", Port: 8080}},
+			shadow:  fakeDiscoverer{"myapp.apps.internal.": {{IPAddress: "10.0.0.1", Port: 9090}}},
+			result:  "mismatch",
+		},
+		{
+			name:    "different IPs",
+			primary: []Host{{IPAddress: "10.0.0.1"}, {IPAddress: "10.0.0.2"}},
+			shadow:  fakeDiscoverer{"myapp.apps.internal.": {{IPAddress: "10.0.0.1", Port: 8080}}},
+			result:  "mismatch",
+		},
+		{
+			name:    "shadow failure",
+			primary: []Host{{IPAddress: "10.0.0.1"}},
+			shadow:  fakeDiscoverer{},
+			result:  "error",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newShadowDiscoverer(fakeDiscoverer{}, tc.shadow, "shadow", 1)
+			name := "myapp.apps.internal."
+			if tc.result == "error" {
+				name = "error.apps.internal."
+			}
+			before := testutil.ToFloat64(ShadowComparisonsCount.WithLabelValues(tc.result))
+			s.compare(name, tc.primary)
+			if v := testutil.ToFloat64(ShadowComparisonsCount.WithLabelValues(tc.result)) - before; v != 1 {
+				t.Errorf("expected a %s comparison, got %v", tc.result, v)
+			}
+		})
+	}
+}
+
+func TestShadowDiscovererSampling(t *testing.T) {
+	shadow := &countingDiscoverer{Discoverer: fakeRoutes}
+
+	s := newShadowDiscoverer(fakeRoutes, shadow, "shadow", 0)
+	for i := 0; i < 10; i++ {
+		if _, err := s.Discover(context.Background(), "v4.apps.internal."); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if count := atomic.LoadInt32(&shadow.count); count != 0 {
+		t.Errorf("expected no shadow lookups with a zero sample rate, got %d", count)
+	}
+
+	// The comparisons are skipped when all the slots are taken.
+	s = newShadowDiscoverer(fakeRoutes, shadow, "shadow", 1)
+	for i := 0; i < shadowConcurrency; i++ {
+		s.slots <- struct{}{}
+	}
+	before := testutil.ToFloat64(ShadowComparisonsCount.WithLabelValues("skipped"))
+	hosts, err := s.Discover(context.Background(), "v4.apps.internal.")
+	if err != nil || len(hosts) != 2 {
+		t.Fatalf("expected the primary hosts, got %v, %v", hosts, err)
+	}
+	if v := testutil.ToFloat64(ShadowComparisonsCount.WithLabelValues("skipped")) - before; v != 1 {
+		t.Errorf("expected a skipped comparison, got %v", v)
+	}
+	if count := atomic.LoadInt32(&shadow.count); count != 0 {
+		t.Errorf("expected no shadow lookups when the slots are taken, got %d", count)
+	}
+}
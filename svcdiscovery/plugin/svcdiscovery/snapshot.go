@@ -0,0 +1,324 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	clog "github.com/coredns/coredns/plugin/pkg/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	snapshotVersion         = 1
+	defaultSnapshotInterval = time.Minute
+	snapshotListTimeout     = 30 * time.Second
+)
+
+// snapshotDiscoverer keeps the routes table listed from the base Discoverer,
+// updated with its answers, and periodically persists it to a snapshot file.
+// On startup, the snapshot is loaded as stale data. A stale route is served
+// when the base Discoverer fails, until the base Discoverer answers for it or
+// lists all the routes successfully.
+type snapshotDiscoverer struct {
+	base     Discoverer
+	path     string
+	interval time.Duration
+	log      clog.P
+
+	mu     sync.RWMutex
+	routes map[string][]Host
+	// stale are the routes loaded from the snapshot that the base Discoverer
+	// hasn't answered successfully yet.
+	stale map[string]struct{}
+	dirty bool
+
+	stopCh chan struct{}
+	doneCh chan struct{}
+}
+
+// snapshotFile is the format of the snapshot file. The checksum is the SHA-256
+// of the routes JSON.
+type snapshotFile struct {
+	Version   int             `json:"version"`
+	CreatedAt time.Time       `json:"created_at"`
+	Checksum  string          `json:"checksum"`
+	Routes    json.RawMessage `json:"routes"`
+}
+
+func newSnapshotDiscoverer(base Discoverer, path string, interval time.Duration) *snapshotDiscoverer {
+	return &snapshotDiscoverer{
+		base:     base,
+		path:     path,
+		interval: interval,
+		log:      clog.NewWithPlugin(pluginName),
+		routes:   make(map[string][]Host),
+		stale:    make(map[string]struct{}),
+		stopCh:   make(chan struct{}),
+		doneCh:   make(chan struct{}),
+	}
+}
+
+// Start loads the snapshot, if any, and starts refreshing the routes table
+// from the base Discoverer and writing it periodically. A missing or invalid
+// snapshot is not fatal.
+func (s *snapshotDiscoverer) Start() error {
+	if err := s.load(); err != nil {
+		s.log.Warning(err)
+	}
+
+	go func() {
+		defer close(s.doneCh)
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			s.refresh()
+			if err := s.write(); err != nil {
+				s.log.Error(err)
+			}
+			select {
+			case <-s.stopCh:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
+
+// Stop stops writing the snapshot periodically and writes it a last time.
+func (s *snapshotDiscoverer) Stop() error {
+	close(s.stopCh)
+	<-s.doneCh
+	return s.write()
+}
+
+// Discover satisfies Discoverer.Discover.
+func (s *snapshotDiscoverer) Discover(ctx context.Context, domainName string) ([]Host, error) {
+	hosts, err := s.base.Discover(ctx, domainName)
+	// The routes table is keyed by the canonical names, as listed.
+	name := dns.CanonicalName(domainName)
+	if err != nil {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		if _, ok := s.stale[name]; ok {
+			s.log.Debugf("%s: serving stale hosts from the snapshot: %v", name, err)
+			return s.routes[name], nil
+		}
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.stale, name)
+	if len(hosts) > 0 {
+		s.routes[name] = hosts
+		s.dirty = true
+	} else if _, ok := s.routes[name]; ok {
+		delete(s.routes, name)
+		s.dirty = true
+	}
+	return hosts, nil
+}
+
+// List returns the routes of the base Discoverer, or the routes table while
+// some of its routes are stale and the base Discoverer fails. It satisfies
+// Lister.List.
+func (s *snapshotDiscoverer) List(ctx context.Context) (map[string][]Host, error) {
+	routes, err := listRoutes(ctx, s.base)
+	if err == nil {
+		s.replace(routes)
+		return routes, nil
+	}
+	s.mu.RLock()
+	stale := len(s.stale) > 0
+	s.mu.RUnlock()
+	if !stale {
+		return nil, err
+	}
+	s.log.Debugf("Serving stale routes from the snapshot: %v", err)
+	return s.table(), nil
+}
+
+// refresh replaces the routes table with the routes listed from the base
+// Discoverer. The table is kept as is when they can't be listed.
+func (s *snapshotDiscoverer) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotListTimeout)
+	defer cancel()
+	routes, err := listRoutes(ctx, s.base)
+	if err != nil {
+		s.log.Warningf("Failed to refresh the snapshot routes: %v", err)
+		return
+	}
+	s.replace(routes)
+}
+
+// replace replaces the routes table with the routes, which are no longer
+// stale.
+func (s *snapshotDiscoverer) replace(routes map[string][]Host) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.stale) > 0 {
+		s.log.Info("Discovery backend is available, no longer serving stale routes from the snapshot")
+	}
+	s.routes = make(map[string][]Host, len(routes))
+	for name, hosts := range routes {
+		if len(hosts) > 0 {
+			s.routes[name] = hosts
+		}
+	}
+	s.stale = make(map[string]struct{})
+	s.dirty = true
+}
+
+// table returns a copy of the routes table.
+func (s *snapshotDiscoverer) table() map[string][]Host {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	routes := make(map[string][]Host, len(s.routes))
+	for name, hosts := range s.routes {
+		routes[name] = hosts
+	}
+	return routes
+}
+
+// flush removes the route from the routes table, returning whether it was
+// there.
+func (s *snapshotDiscoverer) flush(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.routes[name]; !ok {
+		return false
+	}
+	delete(s.routes, name)
+	delete(s.stale, name)
+	s.dirty = true
+	return true
+}
+
+// flushAll empties the routes table.
+func (s *snapshotDiscoverer) flushAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.routes = make(map[string][]Host)
+	s.stale = make(map[string]struct{})
+	s.dirty = true
+}
+
+// load reads the snapshot file into the routes table.
+func (s *snapshotDiscoverer) load() error {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load snapshot: %w", err)
+	}
+
+	var file snapshotFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("failed to load snapshot: %w", err)
+	}
+	if file.Version != snapshotVersion {
+		return fmt.Errorf("failed to load snapshot: unsupported version %d", file.Version)
+	}
+	if checksum := snapshotChecksum(file.Routes); checksum != file.Checksum {
+		return fmt.Errorf("failed to load snapshot: checksum mismatch")
+	}
+	var routes map[string][]Host
+	if err := json.Unmarshal(file.Routes, &routes); err != nil {
+		return fmt.Errorf("failed to load snapshot: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.routes = routes
+	for name := range routes {
+		s.stale[name] = struct{}{}
+	}
+	s.log.Infof("Loaded %d routes from the snapshot created at %s", len(routes), file.CreatedAt)
+	return nil
+}
+
+// write atomically replaces the snapshot file with the routes table if it
+// changed since it was last written.
+func (s *snapshotDiscoverer) write() (err error) {
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	routes, err := json.Marshal(s.routes)
+	s.dirty = false
+	s.mu.Unlock()
+	// Retry on the next interval if the snapshot couldn't be written.
+	defer func() {
+		if err != nil {
+			s.mu.Lock()
+			s.dirty = true
+			s.mu.Unlock()
+		}
+	}()
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	data, err := json.Marshal(snapshotFile{
+		Version:   snapshotVersion,
+		CreatedAt: time.Now().UTC(),
+		Checksum:  snapshotChecksum(routes),
+		Routes:    routes,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	return nil
+}
+
+func snapshotChecksum(routes []byte) string {
+	sum := sha256.Sum256(routes)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// outageDiscoverer is a fakeDiscoverer failing to list its routes while it's
+// down.
+type outageDiscoverer struct {
+	fakeDiscoverer
+
+	mu   sync.Mutex
+	down bool
+}
+
+func (od *outageDiscoverer) List(ctx context.Context) (map[string][]Host, error) {
+	od.mu.Lock()
+	defer od.mu.Unlock()
+	if od.down {
+		return nil, errors.New("fake lister failure")
+	}
+	return od.fakeDiscoverer.List(ctx)
+}
+
+func TestSnapshotDiscoverer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svcdiscovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.json")
+
+	// The snapshot is written from the listed routes, queried or not.
+	routes := fakeDiscoverer{
+		"error.apps.internal.": {{IPAddress: "10.11.12.13"}},
+		"myapp.apps.internal.": {{IPAddress: "10.11.12.14"}},
+	}
+	sd := newSnapshotDiscoverer(routes, path, defaultSnapshotInterval)
+	if err := sd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := sd.Stop(); err != nil {
+		t.Fatal(err)
+	}
+
+	// After a restart with a failing backend, the snapshot is served.
+	backend := &outageDiscoverer{fakeDiscoverer: fakeDiscoverer{"myapp.apps.internal.": routes["myapp.apps.internal."]}, down: true}
+	sd = newSnapshotDiscoverer(backend, path, defaultSnapshotInterval)
+	if err := sd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer sd.Stop()
+	listed, err := sd.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(listed, map[string][]Host(routes)) {
+		t.Errorf("expected the snapshot routes, got %+v", listed)
+	}
+	// The names are case-insensitive, e.g. with 0x20 randomization.
+	hosts, err := sd.Discover(context.Background(), "ErRor.apps.INTERNAL.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hosts, routes["error.apps.internal."]) {
+		t.Errorf("expected the snapshot hosts, got %+v", hosts)
+	}
+
+	// Once the backend answers for other routes, the snapshot is still served
+	// for the failing one.
+	if _, err := sd.Discover(context.Background(), "MyApp.apps.internal."); err != nil {
+		t.Fatal(err)
+	}
+	if table := sd.table(); len(table) != 2 {
+		t.Errorf("expected the routes to be keyed by their canonical name, got %v", table)
+	}
+	if _, err := sd.Discover(context.Background(), "error.apps.internal."); err != nil {
+		t.Errorf("expected the snapshot hosts, got %v", err)
+	}
+
+	// Once the backend lists the routes, the snapshot is no longer served.
+	backend.mu.Lock()
+	backend.fakeDiscoverer = fakeDiscoverer{}
+	backend.down = false
+	backend.mu.Unlock()
+	if _, err := sd.List(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sd.Discover(context.Background(), "error.apps.internal."); err == nil {
+		t.Error("expected the backend error")
+	}
+}
+
+func TestSnapshotDiscovererChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "svcdiscovery")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.json")
+
+	snapshot := `{"version": 1, "checksum": "bogus", "routes": {"error.apps.internal.": [{"ip_address": "10.11.12.13"}]}}`
+	if err := ioutil.WriteFile(path, []byte(snapshot), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sd := newSnapshotDiscoverer(fakeDiscoverer{}, path, defaultSnapshotInterval)
+	if err := sd.load(); err == nil {
+		t.Error("expected a checksum error")
+	}
+}
@@ -0,0 +1,47 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"time"
+)
+
+// staleness drops the discovered hosts that haven't checked in with the SDC
+// recently, since they are likely to be dead containers.
+type staleness struct {
+	maxAge time.Duration
+	// dropAll allows all the hosts to be dropped. Otherwise, the hosts are
+	// returned unfiltered when all of them are stale, as a stale answer is
+	// preferred to no answer.
+	dropAll bool
+}
+
+// filter returns the fresh hosts and the number of hosts that were dropped.
+// Hosts with an empty or unparseable last_check_in are considered fresh.
+func (s *staleness) filter(hosts []Host, now time.Time) ([]Host, int) {
+	fresh := make([]Host, 0, len(hosts))
+	for _, host := range hosts {
+		checkIn, err := time.Parse(time.RFC3339Nano, host.LastCheckIn)
+		if err != nil || now.Sub(checkIn) <= s.maxAge {
+			fresh = append(fresh, host)
+		}
+	}
+	if len(fresh) == 0 && !s.dropAll {
+		return hosts, 0
+	}
+	return fresh, len(hosts) - len(fresh)
+}
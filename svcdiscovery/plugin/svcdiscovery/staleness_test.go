@@ -0,0 +1,102 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStalenessFilter(t *testing.T) {
+	now := time.Date(2020, 7, 1, 12, 0, 0, 0, time.UTC)
+	fresh := Host{IPAddress: "10.0.0.1", LastCheckIn: now.Add(-time.Minute).Format(time.RFC3339Nano)}
+	stale := Host{IPAddress: "10.0.0.2", LastCheckIn: now.Add(-time.Hour).Format(time.RFC3339Nano)}
+	empty := Host{IPAddress: "10.0.0.3"}
+	unparseable := Host{IPAddress: "10.0.0.4", LastCheckIn: "yesterday"}
+
+	tests := []struct {
+		name     string
+		dropAll  bool
+		hosts    []Host
+		expected []Host
+		dropped  int
+	}{
+		{
+			name:     "fresh and stale hosts",
+			hosts:    []Host{fresh, stale},
+			expected: []Host{fresh},
+			dropped:  1,
+		},
+		{
+			name:     "empty and unparseable check-ins are fresh",
+			hosts:    []Host{empty, unparseable, stale},
+			expected: []Host{empty, unparseable},
+			dropped:  1,
+		},
+		{
+			name:     "all stale hosts are kept",
+			hosts:    []Host{stale, stale},
+			expected: []Host{stale, stale},
+			dropped:  0,
+		},
+		{
+			name:     "all stale hosts are dropped with drop_all",
+			dropAll:  true,
+			hosts:    []Host{stale, stale},
+			expected: []Host{},
+			dropped:  2,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &staleness{maxAge: 5 * time.Minute, dropAll: tc.dropAll}
+			hosts, dropped := s.filter(tc.hosts, now)
+			if dropped != tc.dropped {
+				t.Errorf("expected %d dropped hosts, got %d", tc.dropped, dropped)
+			}
+			if len(hosts) != len(tc.expected) {
+				t.Fatalf("expected %v, got %v", tc.expected, hosts)
+			}
+			for i := range hosts {
+				if hosts[i].IPAddress != tc.expected[i].IPAddress {
+					t.Errorf("expected %v, got %v", tc.expected, hosts)
+				}
+			}
+		})
+	}
+}
+
+func TestUsableStaleHostsCount(t *testing.T) {
+	sd := newTestServiceDiscovery()
+	sd.staleness = &staleness{maxAge: 5 * time.Minute}
+	checkIn := time.Now().Add(-time.Hour).Format(time.RFC3339Nano)
+	hosts := []Host{
+		{IPAddress: "10.0.0.1"},
+		{IPAddress: "10.0.0.2", LastCheckIn: checkIn},
+		{IPAddress: "10.0.0.3", LastCheckIn: checkIn},
+	}
+
+	before := testutil.ToFloat64(StaleHostsCount)
+	if usable := sd.usable("db.apps.internal.", hosts); len(usable) != 1 {
+		t.Errorf("expected 1 usable host, got %v", usable)
+	}
+	if v := testutil.ToFloat64(StaleHostsCount) - before; v != 2 {
+		t.Errorf("expected 2 stale hosts to be counted, got %v", v)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const defaultALPNTag = "alpn"
+
+// serviceBindings builds the SVCB or HTTPS records of the route name from its
+// hosts. There is a record in service mode for every distinct port, with the
+// ALPN protocols listed in the ALPN tag of the hosts and the addresses of the
+// hosts as IP hints.
+func (sd *ServiceDiscovery) serviceBindings(qtype uint16, name string, ttl uint32, hosts []Host) []dns.RR {
+	ports := make([]uint16, 0, 1)
+	byPort := make(map[uint16][]Host)
+	for _, host := range hosts {
+		if _, ok := byPort[host.Port]; !ok {
+			ports = append(ports, host.Port)
+		}
+		byPort[host.Port] = append(byPort[host.Port], host)
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+
+	records := make([]dns.RR, 0, len(ports))
+	for i, port := range ports {
+		var alpn []string
+		var ipv4, ipv6 []net.IP
+		seen := make(map[string]struct{})
+		for _, host := range byPort[port] {
+			if v, ok := host.Tag(sd.alpnTag); ok && sd.alpnTag != "" {
+				for _, protocol := range strings.Split(v, ",") {
+					protocol = strings.TrimSpace(protocol)
+					if _, ok := seen[protocol]; protocol == "" || ok {
+						continue
+					}
+					seen[protocol] = struct{}{}
+					alpn = append(alpn, protocol)
+				}
+			}
+			ip := net.ParseIP(host.IPAddress)
+			if ip4 := ip.To4(); ip4 != nil {
+				ipv4 = append(ipv4, ip4)
+			} else if ip != nil {
+				ipv6 = append(ipv6, ip)
+			}
+		}
+
+		// The keys must be in increasing order.
+		var values []dns.SVCBKeyValue
+		if len(alpn) > 0 {
+			values = append(values, &dns.SVCBAlpn{Alpn: alpn})
+		}
+		if port != 0 {
+			values = append(values, &dns.SVCBPort{Port: port})
+		}
+		if len(ipv4) > 0 {
+			values = append(values, &dns.SVCBIPv4Hint{Hint: ipv4})
+		}
+		if len(ipv6) > 0 {
+			values = append(values, &dns.SVCBIPv6Hint{Hint: ipv6})
+		}
+
+		svcb := dns.SVCB{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: qtype,
+				Class:  dns.ClassINET,
+				Ttl:    ttl,
+			},
+			Priority: uint16(i + 1),
+			Target:   ".",
+			Value:    values,
+		}
+		if qtype == dns.TypeHTTPS {
+			records = append(records, &dns.HTTPS{SVCB: svcb})
+		} else {
+			records = append(records, &svcb)
+		}
+	}
+	return records
+}
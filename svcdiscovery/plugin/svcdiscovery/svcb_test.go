@@ -0,0 +1,77 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestServeDNSServiceBindings(t *testing.T) {
+	sd := newTestServiceDiscovery()
+	sd.alpnTag = defaultALPNTag
+	sd.discoverer = fakeDiscoverer{
+		"myapp.apps.internal.": {
+			{IPAddress: "10.11.12.13", Port: 8080, Tags: map[string]interface{}{"alpn": "h2,http/1.1"}},
+			{IPAddress: "2001:db8::68", Port: 8080, Tags: map[string]interface{}{"alpn": "h2"}},
+			{IPAddress: "10.11.12.14", Port: 9090},
+		},
+	}
+
+	tests := []struct {
+		qtype    uint16
+		expected []string
+	}{
+		{
+			qtype: dns.TypeSVCB,
+			expected: []string{
+				`myapp.apps.internal.	300	IN	SVCB	1 . alpn="h2,http/1.1" port="8080" ipv4hint="10.11.12.13" ipv6hint="2001:db8::68"`,
+				`myapp.apps.internal.	300	IN	SVCB	2 . port="9090" ipv4hint="10.11.12.14"`,
+			},
+		},
+		{
+			qtype: dns.TypeHTTPS,
+			expected: []string{
+				`myapp.apps.internal.	300	IN	HTTPS	1 . alpn="h2,http/1.1" port="8080" ipv4hint="10.11.12.13" ipv6hint="2001:db8::68"`,
+				`myapp.apps.internal.	300	IN	HTTPS	2 . port="9090" ipv4hint="10.11.12.14"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(dns.TypeToString[tt.qtype], func(t *testing.T) {
+			req := new(dns.Msg)
+			req.SetQuestion("myapp.apps.internal.", tt.qtype)
+			rec := dnstest.NewRecorder(&test.ResponseWriter{})
+			if _, err := sd.ServeDNS(context.Background(), rec, req); err != nil {
+				t.Fatal(err)
+			}
+			if len(rec.Msg.Answer) != len(tt.expected) {
+				t.Fatalf("expected %d records, got %v", len(tt.expected), rec.Msg.Answer)
+			}
+			for i, rr := range rec.Msg.Answer {
+				if rr.String() != tt.expected[i] {
+					t.Errorf("expected %q, got %q", tt.expected[i], rr.String())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,97 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"fmt"
+	"net"
+)
+
+// ipv6SynthesisMode controls how IPv4 hosts are answered to AAAA questions.
+type ipv6SynthesisMode int
+
+const (
+	// ipv6SynthesisMapped answers with IPv4-mapped IPv6 addresses
+	// (::ffff:a.b.c.d).
+	ipv6SynthesisMapped ipv6SynthesisMode = iota
+	// ipv6SynthesisNone doesn't answer IPv4 hosts, resulting in NODATA when
+	// there are no IPv6 hosts.
+	ipv6SynthesisNone
+	// ipv6SynthesisDNS64 answers with addresses synthesised in a NAT64 prefix.
+	ipv6SynthesisDNS64
+)
+
+// ipv6Synthesis synthesises IPv6 addresses for IPv4 hosts.
+type ipv6Synthesis struct {
+	mode   ipv6SynthesisMode
+	prefix *net.IPNet
+}
+
+func parseIPv6Synthesis(args []string) (*ipv6Synthesis, error) {
+	switch {
+	case len(args) == 1 && args[0] == "none":
+		return &ipv6Synthesis{mode: ipv6SynthesisNone}, nil
+	case len(args) == 1 && args[0] == "mapped":
+		return &ipv6Synthesis{mode: ipv6SynthesisMapped}, nil
+	case len(args) == 2 && args[0] == "dns64":
+		_, prefix, err := net.ParseCIDR(args[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid dns64 prefix: %w", err)
+		}
+		if prefix.IP.To4() != nil {
+			return nil, fmt.Errorf("invalid dns64 prefix: %s is not an IPv6 prefix", args[1])
+		}
+		switch ones, _ := prefix.Mask.Size(); ones {
+		case 32, 40, 48, 56, 64, 96:
+		default:
+			return nil, fmt.Errorf("invalid dns64 prefix: %s must have a length of 32, 40, 48, 56, 64 or 96", args[1])
+		}
+		return &ipv6Synthesis{mode: ipv6SynthesisDNS64, prefix: prefix}, nil
+	default:
+		return nil, fmt.Errorf("invalid ipv6_synthesis: %v", args)
+	}
+}
+
+// synthesise returns the IPv6 address to be answered for the IPv4 address, or
+// nil if it must not be answered.
+func (s *ipv6Synthesis) synthesise(ip4 net.IP) net.IP {
+	switch s.mode {
+	case ipv6SynthesisNone:
+		return nil
+	case ipv6SynthesisDNS64:
+		return embedIPv4(s.prefix, ip4.To4())
+	default:
+		return ip4.To16()
+	}
+}
+
+// embedIPv4 embeds the IPv4 address in the IPv6 prefix as described in RFC 6052
+// section 2.2, skipping the reserved bits 64 to 71.
+func embedIPv4(prefix *net.IPNet, ip4 net.IP) net.IP {
+	ip6 := make(net.IP, net.IPv6len)
+	copy(ip6, prefix.IP.To16())
+	ones, _ := prefix.Mask.Size()
+	n := ones / 8
+	for _, b := range ip4 {
+		if n == 8 {
+			n++
+		}
+		ip6[n] = b
+		n++
+	}
+	return ip6
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/coredns/coredns/request"
+	"github.com/miekg/dns"
+)
+
+// transferTimeout bounds listing the routes of a zone for a transfer.
+const transferTimeout = 30 * time.Second
+
+// Transfer streams the records of an owned zone, built from the complete list
+// of routes, starting with its SOA record. An IXFR from a serial that is
+// already current only gets the SOA record; older serials get the whole zone.
+// It satisfies transfer.Transferer.Transfer.
+func (sd *ServiceDiscovery) Transfer(zone string, serial uint32) (<-chan []dns.RR, error) {
+	zone = dns.Fqdn(dns.CanonicalName(zone))
+	if sd.zones == nil || !sd.zones.owns(zone) {
+		return nil, transfer.ErrNotAuthoritative
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), transferTimeout)
+	defer cancel()
+	current, records, err := sd.zoneSerial(ctx, zone)
+	if err != nil {
+		sd.log.Error(err)
+		return nil, err
+	}
+	soa := sd.zoneSOA(zone, current)
+
+	ch := make(chan []dns.RR, 2)
+	ch <- []dns.RR{soa}
+	if serial == 0 || serial < soa.Serial {
+		ch <- append([]dns.RR{sd.zones.ns(zone, soa.Hdr.Ttl)}, records...)
+	}
+	close(ch)
+	return ch, nil
+}
+
+// zoneRecords builds the A, AAAA and SRV records of the routes in the zone,
+// and the CNAME records of the configured aliases. Every distinct port of a
+// route gets an SRV record targeting the route.
+func (sd *ServiceDiscovery) zoneRecords(zone string, routes map[string][]Host) []dns.RR {
+	names := make([]string, 0, len(routes))
+	for name := range routes {
+		if dns.IsSubDomain(zone, name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var records []dns.RR
+	for _, name := range names {
+		hosts := sd.usableHosts(routes[name])
+		if len(hosts) == 0 {
+			continue
+		}
+		ttl := sd.ttl.answer(name, hosts)
+		hdr := func(rrtype uint16) dns.RR_Header {
+			return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: ttl}
+		}
+		ports := make(map[uint16]struct{})
+		for _, host := range hosts {
+			ip := net.ParseIP(host.IPAddress)
+			if ip4 := ip.To4(); ip4 != nil {
+				records = append(records, &dns.A{Hdr: hdr(dns.TypeA), A: ip4})
+			} else {
+				records = append(records, &dns.AAAA{Hdr: hdr(dns.TypeAAAA), AAAA: ip})
+			}
+			if _, ok := ports[host.Port]; host.Port == 0 || ok {
+				continue
+			}
+			ports[host.Port] = struct{}{}
+			records = append(records, &dns.SRV{Hdr: hdr(dns.TypeSRV), Port: host.Port, Target: name})
+		}
+	}
+
+	if sd.aliases != nil {
+		from := make([]string, 0, len(sd.aliases.static))
+		for name := range sd.aliases.static {
+			if dns.IsSubDomain(zone, name) {
+				from = append(from, name)
+			}
+		}
+		sort.Strings(from)
+		for _, name := range from {
+			records = append(records, &dns.CNAME{
+				Hdr:    dns.RR_Header{Name: name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: sd.ttl.answer(name, nil)},
+				Target: sd.aliases.static[name],
+			})
+		}
+	}
+	return records
+}
+
+// transferAllowed returns whether the client is allowed to transfer the zones.
+func (sd *ServiceDiscovery) transferAllowed(state request.Request) bool {
+	return containsIP(sd.transferAllow, net.ParseIP(state.IP()))
+}
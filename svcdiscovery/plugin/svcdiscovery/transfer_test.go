@@ -0,0 +1,137 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/coredns/coredns/plugin/transfer"
+	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func collect(ch <-chan []dns.RR) []dns.RR {
+	var records []dns.RR
+	for rrs := range ch {
+		records = append(records, rrs...)
+	}
+	return records
+}
+
+func TestTransfer(t *testing.T) {
+	sd := newTestServiceDiscovery()
+	sd.discoverer = fakeDiscoverer{
+		"myapp.apps.internal.": {
+			{IPAddress: "10.11.12.13", Port: 8080},
+			{IPAddress: "10.11.12.14", Port: 8080},
+		},
+		"v6.apps.internal.": {
+			{IPAddress: "2001:db8::68"},
+		},
+		"bogus.apps.internal.": {
+			{IPAddress: "127.0.0.1"},
+		},
+		"other.zone.": {
+			{IPAddress: "10.11.12.15"},
+		},
+	}
+	sd.zones = newZoneAuthority([]string{"apps.internal."})
+
+	if _, err := sd.Transfer("other.zone.", 0); err != transfer.ErrNotAuthoritative {
+		t.Fatalf("expected ErrNotAuthoritative, got %v", err)
+	}
+
+	// The bogus address is left out of the zone without being counted as
+	// removed from an answer.
+	rejected := testutil.ToFloat64(RejectedAddressesCount.WithLabelValues("loopback"))
+	ch, err := sd.Transfer("apps.internal.", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := collect(ch)
+	if v := testutil.ToFloat64(RejectedAddressesCount.WithLabelValues("loopback")); v != rejected {
+		t.Errorf("expected the rejected addresses count to be unchanged, got %v", v-rejected)
+	}
+	expected := []string{
+		"apps.internal.\t300\tIN\tNS\tns.dns.apps.internal.",
+		"myapp.apps.internal.\t300\tIN\tA\t10.11.12.13",
+		"myapp.apps.internal.\t300\tIN\tSRV\t0 0 8080 myapp.apps.internal.",
+		"myapp.apps.internal.\t300\tIN\tA\t10.11.12.14",
+		"v6.apps.internal.\t300\tIN\tAAAA\t2001:db8::68",
+	}
+	if len(records) != len(expected)+1 {
+		t.Fatalf("expected %d records, got %v", len(expected)+1, records)
+	}
+	soa, ok := records[0].(*dns.SOA)
+	if !ok {
+		t.Fatalf("expected the first record to be the SOA, got %v", records[0])
+	}
+	for i, rr := range records[1:] {
+		if rr.String() != expected[i] {
+			t.Errorf("expected record %q, got %q", expected[i], rr.String())
+		}
+	}
+
+	// The serial doesn't change while the records don't, and an IXFR from the
+	// current serial only gets the SOA.
+	ch, err = sd.Transfer("apps.internal.", soa.Serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records = collect(ch)
+	if len(records) != 1 || records[0].(*dns.SOA).Serial != soa.Serial {
+		t.Errorf("expected only the SOA with serial %d, got %v", soa.Serial, records)
+	}
+
+	// Changing the routes bumps the serial.
+	sd.discoverer.(fakeDiscoverer)["new.apps.internal."] = []Host{{IPAddress: "10.11.12.16"}}
+	ch, err = sd.Transfer("apps.internal.", soa.Serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records = collect(ch)
+	if records[0].(*dns.SOA).Serial <= soa.Serial || len(records) != len(expected)+2 {
+		t.Errorf("expected the whole zone with a new serial, got %v", records)
+	}
+}
+
+func TestServeDNSTransferACL(t *testing.T) {
+	sd := newTestServiceDiscovery()
+	sd.zones = newZoneAuthority([]string{"apps.internal."})
+	_, subnet, _ := net.ParseCIDR("10.240.0.0/16")
+	sd.transferAllow = []*net.IPNet{subnet}
+
+	req := new(dns.Msg)
+	req.SetAxfr("apps.internal.")
+
+	// The test writer's client is 10.240.0.1, so the transfer is passed to the
+	// next plugin.
+	rec := dnstest.NewRecorder(&test.ResponseWriter{})
+	if code, _ := sd.ServeDNS(context.Background(), rec, req); code != dns.RcodeNameError {
+		t.Errorf("expected the transfer to be passed to the next plugin, got rcode %d", code)
+	}
+
+	sd.transferAllow = nil
+	rec = dnstest.NewRecorder(&test.ResponseWriter{})
+	if code, _ := sd.ServeDNS(context.Background(), rec, req); code != dns.RcodeRefused {
+		t.Errorf("expected the transfer to be refused, got rcode %d", code)
+	}
+}
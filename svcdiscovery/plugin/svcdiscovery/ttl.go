@@ -0,0 +1,153 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"sort"
+	"strconv"
+
+	"github.com/coredns/coredns/plugin/pkg/dnsutil"
+	"github.com/miekg/dns"
+)
+
+// ttlPolicy computes the TTL of the records in an answer.
+type ttlPolicy struct {
+	// ttl is the default TTL.
+	ttl uint32
+	// zones overrides the default TTL for the names under a zone. The longest
+	// matching zone wins.
+	zones map[string]uint32
+	// sorted are the zones, longest first. It's set by sortZones once the zones
+	// are configured.
+	sorted []string
+	// tag is the host tag carrying a TTL hint. When set, the lowest hint among
+	// the answered hosts overrides the zone TTL.
+	tag string
+	min uint32
+	// max is ignored when zero.
+	max uint32
+	// negative is the TTL of negative answers. Negative answers carry no SOA
+	// record, and are therefore not cached downstream, when it's nil.
+	negative *uint32
+}
+
+func newTTLPolicy() *ttlPolicy {
+	return &ttlPolicy{zones: make(map[string]uint32)}
+}
+
+// answer returns the TTL for the records of qname built from the hosts.
+func (p *ttlPolicy) answer(qname string, hosts []Host) uint32 {
+	ttl := p.ttl
+	if zone := p.zone(qname); zone != "" {
+		ttl = p.zones[zone]
+	}
+	if p.tag != "" {
+		hinted := false
+		var hint uint32
+		for _, host := range hosts {
+			v, ok := host.Tag(p.tag)
+			if !ok {
+				continue
+			}
+			u, err := strconv.ParseUint(v, 10, 32)
+			if err != nil {
+				continue
+			}
+			if !hinted || uint32(u) < hint {
+				hint = uint32(u)
+				hinted = true
+			}
+		}
+		if hinted {
+			ttl = hint
+		}
+	}
+	return p.clamp(ttl)
+}
+
+// sortZones sorts the configured zones, longest first, for zone to return the
+// longest match.
+func (p *ttlPolicy) sortZones() {
+	p.sorted = make([]string, 0, len(p.zones))
+	for zone := range p.zones {
+		p.sorted = append(p.sorted, zone)
+	}
+	sort.Slice(p.sorted, func(i, j int) bool {
+		return len(p.sorted[i]) > len(p.sorted[j])
+	})
+}
+
+// zone returns the longest configured zone containing qname.
+func (p *ttlPolicy) zone(qname string) string {
+	for _, zone := range p.sorted {
+		if dns.IsSubDomain(zone, qname) {
+			return zone
+		}
+	}
+	return ""
+}
+
+func (p *ttlPolicy) clamp(ttl uint32) uint32 {
+	if ttl < p.min {
+		ttl = p.min
+	}
+	if p.max != 0 && ttl > p.max {
+		ttl = p.max
+	}
+	return ttl
+}
+
+// longestZone returns the longest zone containing qname, or an empty string if
+// none of them does.
+func longestZone(zones []string, qname string) string {
+	longest := ""
+	for _, zone := range zones {
+		if dns.IsSubDomain(zone, qname) && len(zone) > len(longest) {
+			longest = zone
+		}
+	}
+	return longest
+}
+
+// negativeSOA returns the SOA record to be placed in the authority section of a
+// negative answer for qname, from which resolvers take the negative TTL. It
+// returns nil when no negative TTL is configured or when qname is not under a
+// configured zone, as there is no zone apex to vouch for.
+func (p *ttlPolicy) negativeSOA(qname string) dns.RR {
+	if p.negative == nil {
+		return nil
+	}
+	zone := p.zone(qname)
+	if zone == "" {
+		return nil
+	}
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    *p.negative,
+		},
+		Ns:      dnsutil.Join("ns.dns", zone),
+		Mbox:    dnsutil.Join("hostmaster", zone),
+		Serial:  1,
+		Refresh: 7200,
+		Retry:   1800,
+		Expire:  86400,
+		Minttl:  *p.negative,
+	}
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"testing"
+)
+
+func TestTTLPolicyAnswer(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   *ttlPolicy
+		qname    string
+		hosts    []Host
+		expected uint32
+	}{
+		{
+			name:     "default",
+			policy:   &ttlPolicy{ttl: 300},
+			qname:    "myapp.apps.internal.",
+			expected: 300,
+		},
+		{
+			name: "longest zone",
+			policy: &ttlPolicy{ttl: 300, zones: map[string]uint32{
+				"internal.":          60,
+				"apps.internal.":     30,
+				"db.apps.internal.":  10,
+				"other.internal.":    5,
+				"web.apps.internal.": 1,
+			}},
+			qname:    "0.db.apps.internal.",
+			expected: 10,
+		},
+		{
+			name:     "shorter zone",
+			policy:   &ttlPolicy{ttl: 300, zones: map[string]uint32{"internal.": 60, "db.apps.internal.": 10}},
+			qname:    "myapp.apps.internal.",
+			expected: 60,
+		},
+		{
+			name:     "clamped to min",
+			policy:   &ttlPolicy{ttl: 5, min: 30},
+			qname:    "myapp.apps.internal.",
+			expected: 30,
+		},
+		{
+			name:     "clamped to max",
+			policy:   &ttlPolicy{ttl: 3600, max: 600},
+			qname:    "myapp.apps.internal.",
+			expected: 600,
+		},
+		{
+			name:   "lowest tag hint",
+			policy: &ttlPolicy{ttl: 300, zones: map[string]uint32{"apps.internal.": 60}, tag: "ttl"},
+			qname:  "myapp.apps.internal.",
+			hosts: []Host{
+				{Tags: map[string]interface{}{"ttl": "120"}},
+				{Tags: map[string]interface{}{"ttl": "90"}},
+				{Tags: map[string]interface{}{"ttl": "invalid"}},
+				{},
+			},
+			expected: 90,
+		},
+		{
+			name:     "tag hint clamped",
+			policy:   &ttlPolicy{ttl: 300, tag: "ttl", min: 30},
+			qname:    "myapp.apps.internal.",
+			hosts:    []Host{{Tags: map[string]interface{}{"ttl": "1"}}},
+			expected: 30,
+		},
+		{
+			name:     "no tag hint",
+			policy:   &ttlPolicy{ttl: 300, tag: "ttl"},
+			qname:    "myapp.apps.internal.",
+			hosts:    []Host{{Tags: map[string]interface{}{"ttl": "invalid"}}},
+			expected: 300,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.policy.sortZones()
+			if ttl := tc.policy.answer(tc.qname, tc.hosts); ttl != tc.expected {
+				t.Errorf("expected TTL %d, got %d", tc.expected, ttl)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnsutil"
+	"github.com/miekg/dns"
+)
+
+// Default SOA timers, in seconds.
+const (
+	defaultSOARefresh = 7200
+	defaultSOARetry   = 1800
+	defaultSOAExpire  = 86400
+)
+
+// zoneRefreshInterval is the interval between the listings of the routes for
+// the SOA serials of the zones, and zoneRefreshTimeout bounds each of them.
+const (
+	zoneRefreshInterval = 30 * time.Second
+	zoneRefreshTimeout  = 30 * time.Second
+)
+
+// zoneAuthority holds the internal zones owned by the plugin and tracks the
+// SOA serial of each of them.
+type zoneAuthority struct {
+	zones []string
+	// mname is the name server of the zones, used in their SOA and NS records.
+	// Defaults to ns.dns under each zone when empty.
+	mname string
+	// rname is the mailbox of the person responsible for the zones, in domain
+	// name form. Defaults to hostmaster under each zone when empty.
+	rname   string
+	refresh uint32
+	retry   uint32
+	expire  uint32
+
+	mu      sync.Mutex
+	serials map[string]zoneSerial
+	// checked is the last time the serials were refreshed from the routes.
+	checked    time.Time
+	refreshing bool
+}
+
+// zoneSerial is the SOA serial of a zone and the hash of the zone records it
+// was assigned to.
+type zoneSerial struct {
+	serial uint32
+	hash   string
+}
+
+func newZoneAuthority(zones []string) *zoneAuthority {
+	return &zoneAuthority{
+		zones:   zones,
+		refresh: defaultSOARefresh,
+		retry:   defaultSOARetry,
+		expire:  defaultSOAExpire,
+		serials: make(map[string]zoneSerial),
+	}
+}
+
+// owner returns the longest owned zone containing qname, or an empty string if
+// none of them does.
+func (za *zoneAuthority) owner(qname string) string {
+	return longestZone(za.zones, qname)
+}
+
+// owns returns whether zone is the apex of an owned zone.
+func (za *zoneAuthority) owns(zone string) bool {
+	for _, z := range za.zones {
+		if z == zone {
+			return true
+		}
+	}
+	return false
+}
+
+// serial returns the SOA serial of the zone for its current records. The
+// serial is bumped, to the current Unix time when possible, whenever the
+// records change.
+func (za *zoneAuthority) serial(zone string, records []dns.RR, now time.Time) uint32 {
+	lines := make([]string, len(records))
+	for i, rr := range records {
+		lines[i] = rr.String()
+	}
+	// The backends don't guarantee any order for the hosts of a route.
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	hash := hex.EncodeToString(sum[:])
+
+	za.mu.Lock()
+	defer za.mu.Unlock()
+	current, ok := za.serials[zone]
+	if ok && current.hash == hash {
+		return current.serial
+	}
+	serial := uint32(now.Unix())
+	if ok && serial <= current.serial {
+		serial = current.serial + 1
+	}
+	za.serials[zone] = zoneSerial{serial: serial, hash: hash}
+	return serial
+}
+
+// current returns the last serial of the zone, assigning the current Unix time
+// to a zone without any.
+func (za *zoneAuthority) current(zone string, now time.Time) uint32 {
+	za.mu.Lock()
+	defer za.mu.Unlock()
+	current, ok := za.serials[zone]
+	if !ok {
+		current = zoneSerial{serial: uint32(now.Unix())}
+		za.serials[zone] = current
+	}
+	return current.serial
+}
+
+// due returns whether the serials are to be refreshed from the routes, and
+// whether they never were. A caller getting true must call refreshed once
+// done.
+func (za *zoneAuthority) due(now time.Time) (due, initial bool) {
+	za.mu.Lock()
+	defer za.mu.Unlock()
+	if za.refreshing || now.Sub(za.checked) < zoneRefreshInterval {
+		return false, false
+	}
+	za.refreshing = true
+	return true, za.checked.IsZero()
+}
+
+// refreshed records the end of a refresh of the serials, successful or not.
+func (za *zoneAuthority) refreshed(now time.Time) {
+	za.mu.Lock()
+	defer za.mu.Unlock()
+	za.refreshing = false
+	za.checked = now
+}
+
+// soa returns the SOA record of the zone.
+func (za *zoneAuthority) soa(zone string, serial, ttl, minttl uint32) *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Ns:      za.nameServer(zone),
+		Mbox:    za.mailbox(zone),
+		Serial:  serial,
+		Refresh: za.refresh,
+		Retry:   za.retry,
+		Expire:  za.expire,
+		Minttl:  minttl,
+	}
+}
+
+// ns returns the NS record of the zone.
+func (za *zoneAuthority) ns(zone string, ttl uint32) *dns.NS {
+	return &dns.NS{
+		Hdr: dns.RR_Header{
+			Name:   zone,
+			Rrtype: dns.TypeNS,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Ns: za.nameServer(zone),
+	}
+}
+
+func (za *zoneAuthority) nameServer(zone string) string {
+	if za.mname != "" {
+		return za.mname
+	}
+	return dnsutil.Join("ns.dns", zone)
+}
+
+func (za *zoneAuthority) mailbox(zone string) string {
+	if za.rname != "" {
+		return za.rname
+	}
+	return dnsutil.Join("hostmaster", zone)
+}
+
+// parseMailbox converts an email address to the domain name form used in SOA
+// records, e.g. hostmaster@example.com to hostmaster.example.com.
+func parseMailbox(s string) string {
+	return dns.Fqdn(strings.ToLower(strings.Replace(s, "@", ".", 1)))
+}
+
+// zoneSOA returns the SOA record of the owned zone with the given serial. The
+// negative TTL, when configured, is used as its minimum TTL.
+func (sd *ServiceDiscovery) zoneSOA(zone string, serial uint32) *dns.SOA {
+	ttl := sd.ttl.answer(zone, nil)
+	minttl := ttl
+	if sd.ttl.negative != nil {
+		minttl = *sd.ttl.negative
+	}
+	return sd.zones.soa(zone, serial, ttl, minttl)
+}
+
+// zoneSerial lists the routes to build the records of the owned zone and
+// returns its serial along with the records.
+func (sd *ServiceDiscovery) zoneSerial(ctx context.Context, zone string) (uint32, []dns.RR, error) {
+	routes, err := listRoutes(ctx, sd.discoverer)
+	if err != nil {
+		return 0, nil, err
+	}
+	records := sd.zoneRecords(zone, routes)
+	return sd.zones.serial(zone, records, time.Now()), records, nil
+}
+
+// refreshZones lists the routes once to refresh the serials of all the owned
+// zones. The serials are kept when the routes cannot be listed.
+func (sd *ServiceDiscovery) refreshZones(ctx context.Context) {
+	defer sd.zones.refreshed(time.Now())
+	routes, err := listRoutes(ctx, sd.discoverer)
+	if err != nil {
+		sd.log.Warningf("Failed to refresh the SOA serials: %v", err)
+		return
+	}
+	now := time.Now()
+	for _, zone := range sd.zones.zones {
+		sd.zones.serial(zone, sd.zoneRecords(zone, routes), now)
+	}
+}
+
+// serveApex answers the SOA and NS questions for the apex of an owned zone.
+// The SOA serial is the cached one, refreshed in the background at most every
+// zoneRefreshInterval; only the first SOA question waits for the routes.
+func (sd *ServiceDiscovery) serveApex(ctx context.Context, rw dns.ResponseWriter, req *dns.Msg, zone string) error {
+	res := &dns.Msg{}
+	res.SetReply(req)
+	res.Authoritative = true
+
+	ns := sd.zones.ns(zone, sd.ttl.answer(zone, nil))
+	switch req.Question[0].Qtype {
+	case dns.TypeSOA:
+		if due, initial := sd.zones.due(time.Now()); initial {
+			sd.refreshZones(ctx)
+		} else if due {
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), zoneRefreshTimeout)
+				defer cancel()
+				sd.refreshZones(ctx)
+			}()
+		}
+		res.Answer = []dns.RR{sd.zoneSOA(zone, sd.zones.current(zone, time.Now()))}
+		res.Ns = []dns.RR{ns}
+	case dns.TypeNS:
+		res.Answer = []dns.RR{ns}
+	}
+
+	return rw.WriteMsg(res)
+}
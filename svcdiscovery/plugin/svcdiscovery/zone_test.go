@@ -0,0 +1,138 @@
+/*
+Copyright 2020 SUSE
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package svcdiscovery
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coredns/coredns/plugin/pkg/dnstest"
+	"github.com/coredns/coredns/plugin/test"
+	"github.com/miekg/dns"
+)
+
+func TestZoneAuthoritySerial(t *testing.T) {
+	za := newZoneAuthority([]string{"apps.internal."})
+	now := time.Unix(1600000000, 0)
+	a := test.A("myapp.apps.internal. 300 IN A 10.11.12.13")
+	b := test.A("myapp.apps.internal. 300 IN A 10.11.12.14")
+
+	serial := za.serial("apps.internal.", []dns.RR{a, b}, now)
+	if serial != 1600000000 {
+		t.Errorf("expected the serial to be the Unix time, got %d", serial)
+	}
+	if s := za.serial("apps.internal.", []dns.RR{b, a}, now.Add(time.Hour)); s != serial {
+		t.Errorf("expected the serial to be unchanged for the same records, got %d", s)
+	}
+	if s := za.serial("apps.internal.", []dns.RR{a}, now); s != serial+1 {
+		t.Errorf("expected the serial to be bumped, got %d", s)
+	}
+	if s := za.current("apps.internal.", now); s != serial+1 {
+		t.Errorf("expected the current serial to be %d, got %d", serial+1, s)
+	}
+}
+
+func TestServeDNSZoneApex(t *testing.T) {
+	sd := newTestServiceDiscovery()
+	sd.zones = newZoneAuthority([]string{"apps.internal."})
+	sd.zones.mname = "apps-dns.kubecf.svc.cluster.local."
+	sd.zones.rname = parseMailbox("admin@example.com")
+	sd.zones.refresh = 600
+
+	serve := func(qname string, qtype uint16) *dns.Msg {
+		req := new(dns.Msg)
+		req.SetQuestion(qname, qtype)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := sd.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Msg == nil {
+			t.Fatalf("no answer to %s %s", qname, dns.TypeToString[qtype])
+		}
+		return rec.Msg
+	}
+
+	res := serve("Apps.Internal.", dns.TypeSOA)
+	if len(res.Answer) != 1 || !res.Authoritative {
+		t.Fatalf("expected an authoritative SOA answer, got %v", res)
+	}
+	soa := res.Answer[0].(*dns.SOA)
+	if soa.Ns != "apps-dns.kubecf.svc.cluster.local." || soa.Mbox != "admin.example.com." || soa.Refresh != 600 {
+		t.Errorf("unexpected SOA: %v", soa)
+	}
+
+	// The serial is cached, and changes with the route table once refreshed.
+	sd.discoverer = fakeDiscoverer{"new.apps.internal.": {{IPAddress: "10.11.12.16"}}}
+	if s := serve("apps.internal.", dns.TypeSOA).Answer[0].(*dns.SOA).Serial; s != soa.Serial {
+		t.Errorf("expected the cached serial %d, got %d", soa.Serial, s)
+	}
+	if due, _ := sd.zones.due(time.Now().Add(zoneRefreshInterval)); !due {
+		t.Fatal("expected the serials to be due for a refresh")
+	}
+	sd.refreshZones(context.Background())
+	if s := serve("apps.internal.", dns.TypeSOA).Answer[0].(*dns.SOA).Serial; s == soa.Serial {
+		t.Errorf("expected the serial to change, got %d", s)
+	}
+
+	res = serve("apps.internal.", dns.TypeNS)
+	if len(res.Answer) != 1 || res.Answer[0].(*dns.NS).Ns != "apps-dns.kubecf.svc.cluster.local." {
+		t.Errorf("unexpected NS answer: %v", res.Answer)
+	}
+
+	// Negative answers carry the SOA of the zone.
+	sd.synthesis.mode = ipv6SynthesisNone
+	res = serve("new.apps.internal.", dns.TypeAAAA)
+	if len(res.Answer) != 0 || len(res.Ns) != 1 || res.Ns[0].Header().Rrtype != dns.TypeSOA {
+		t.Errorf("expected a negative answer with an SOA, got %v", res)
+	}
+}
+
+// listingDiscoverer counts the listings of the routes of the wrapped
+// fakeDiscoverer.
+type listingDiscoverer struct {
+	fakeDiscoverer
+	count int32
+}
+
+func (ld *listingDiscoverer) List(ctx context.Context) (map[string][]Host, error) {
+	atomic.AddInt32(&ld.count, 1)
+	return ld.fakeDiscoverer.List(ctx)
+}
+
+func TestServeDNSZoneApexCached(t *testing.T) {
+	discoverer := &listingDiscoverer{fakeDiscoverer: fakeRoutes}
+	sd := newTestServiceDiscovery()
+	sd.discoverer = discoverer
+	sd.zones = newZoneAuthority([]string{"apps.internal.", "other.internal."})
+
+	for _, zone := range []string{"apps.internal.", "other.internal.", "apps.internal."} {
+		req := new(dns.Msg)
+		req.SetQuestion(zone, dns.TypeSOA)
+		rec := dnstest.NewRecorder(&test.ResponseWriter{})
+		if _, err := sd.ServeDNS(context.Background(), rec, req); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Msg == nil || len(rec.Msg.Answer) != 1 {
+			t.Fatalf("expected an SOA answer for %s, got %v", zone, rec.Msg)
+		}
+	}
+	if count := atomic.LoadInt32(&discoverer.count); count != 1 {
+		t.Errorf("expected the routes to be listed once, got %d", count)
+	}
+}